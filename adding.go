@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"sync"
 
 	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
@@ -23,6 +25,10 @@ func (rl *Relay) AddEvent(ctx context.Context, evt *nostr.Event) (skipBroadcast
 }
 
 func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadcast bool, writeError error) {
+	if isExpired(evt) {
+		return true, errors.New("invalid: event is expired")
+	}
+
 	for _, reject := range rl.RejectEvent {
 		if reject, msg := reject(ctx, evt); reject {
 			if msg == "" {
@@ -50,6 +56,32 @@ func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadc
 		return true, errors.New("blocked: this event has been deleted")
 	}
 
+	// or if the author has asked to be forgotten -- nip62
+	if rl.hasVanished(ctx, evt) {
+		return true, errors.New("blocked: the author of this event has requested to vanish")
+	}
+
+	if _, banned := rl.bannedEvents.Load(evt.ID); banned {
+		return true, errors.New("blocked: this event was banned")
+	}
+
+	// events waiting for moderation are stored, but not broadcasted
+	wasHeld := rl.isQuarantined(evt)
+	quarantined, err := rl.quarantine(ctx, evt)
+	if err != nil {
+		return true, fmt.Errorf("%s", nostr.NormalizeOKMessage(err.Error(), "error"))
+	}
+	stored := false
+	if quarantined && !wasHeld {
+		// if it isn't stored now (because of an error, because it was already there, maybe even allowed
+		// by an admin already, or because there is a newer version of it) it shouldn't be held
+		defer func() {
+			if !stored {
+				rl.Quarantine.Release(ctx, evt.ID)
+			}
+		}()
+	}
+
 	// will store
 	// regular kinds are just saved directly
 	if nostr.IsRegularKind(evt.Kind) {
@@ -63,6 +95,7 @@ func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadc
 				}
 			}
 		}
+		stored = true
 	} else {
 		// Check to see if the event has been deleted by address
 		for _, query := range rl.QueryEvents {
@@ -103,6 +136,7 @@ func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadc
 					}
 				}
 			}
+			stored = true
 		} else {
 			// otherwise do it the manual way
 			filter := nostr.Filter{Limit: 1, Kinds: []int{evt.Kind}, Authors: []string{evt.PubKey}}
@@ -111,6 +145,10 @@ func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadc
 				filter.Tags = nostr.TagMap{"d": []string{evt.Tags.GetD()}}
 			}
 
+			// no one else can be replacing this same address until we're done
+			unlock := rl.lockAddress(evt)
+			defer unlock()
+
 			// now we fetch old events and delete them
 			shouldStore := true
 			for _, query := range rl.QueryEvents {
@@ -142,6 +180,7 @@ func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadc
 						}
 					}
 				}
+				stored = true
 			}
 		}
 	}
@@ -153,5 +192,23 @@ func (rl *Relay) handleNormal(ctx context.Context, evt *nostr.Event) (skipBroadc
 	// track event expiration if applicable
 	rl.expirationManager.trackEvent(evt)
 
-	return false, nil
+	return quarantined, nil
+}
+
+// the manual replacement of events with the same address is serialized by these
+const addressLockStripes = 64
+
+type addressLocks [addressLockStripes]sync.Mutex
+
+func (rl *Relay) lockAddress(evt *nostr.Event) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(evt.PubKey))
+	h.Write([]byte{byte(evt.Kind >> 8), byte(evt.Kind)})
+	if nostr.IsAddressableKind(evt.Kind) {
+		h.Write([]byte(evt.Tags.GetD()))
+	}
+
+	mu := &rl.addressLocks[h.Sum32()%addressLockStripes]
+	mu.Lock()
+	return mu.Unlock
 }
@@ -0,0 +1,96 @@
+package khatru
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedStore makes slicestore safe for concurrent use, but each call is still independent from the others
+// and queries take a while, like in a real database
+type lockedStore struct {
+	sync.Mutex
+	slicestore.SliceStore
+}
+
+func (s *lockedStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.SliceStore.SaveEvent(ctx, evt)
+}
+
+func (s *lockedStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.SliceStore.DeleteEvent(ctx, evt)
+}
+
+func (s *lockedStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	s.Lock()
+	ch, err := s.SliceStore.QueryEvents(ctx, filter)
+	if err != nil {
+		s.Unlock()
+		return nil, err
+	}
+	results := make(chan *nostr.Event, 500)
+	for evt := range ch {
+		results <- evt
+	}
+	close(results)
+	s.Unlock()
+
+	time.Sleep(time.Millisecond)
+	return results, nil
+}
+
+func TestConcurrentReplacement(t *testing.T) {
+	relay := NewRelay()
+	store := &lockedStore{}
+	store.Init()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	base := nostr.Now()
+
+	for _, kind := range []int{0, 30023} {
+		for round := range 5 {
+			events := make([]*nostr.Event, 50)
+			for i := range events {
+				evt := &nostr.Event{
+					CreatedAt: base + nostr.Timestamp(round*100+(i*37)%50),
+					Kind:      kind,
+					Tags:      nostr.Tags{{"d", "article"}},
+				}
+				evt.Sign(sk)
+				events[i] = evt
+			}
+
+			wg := sync.WaitGroup{}
+			wg.Add(len(events))
+			for _, evt := range events {
+				go func() {
+					defer wg.Done()
+					_, err := relay.AddEvent(context.Background(), evt)
+					require.NoError(t, err)
+				}()
+			}
+			wg.Wait()
+
+			ch, _ := store.QueryEvents(context.Background(), nostr.Filter{Kinds: []int{kind}, Authors: []string{pk}})
+			stored := make([]*nostr.Event, 0, 1)
+			for evt := range ch {
+				stored = append(stored, evt)
+			}
+			require.Len(t, stored, 1, "kind %d round %d", kind, round)
+			require.Equal(t, base+nostr.Timestamp(round*100+49), stored[0].CreatedAt)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package khatru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// AuditEntry records one call to the management API.
+//
+// entries are chained by their hashes, so removing or changing any entry can be detected with VerifyAuditLog.
+type AuditEntry struct {
+	Timestamp nostr.Timestamp `json:"timestamp"`
+	PubKey    string          `json:"pubkey"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Previous  string          `json:"previous"`
+	Hash      string          `json:"hash"`
+}
+
+func (entry AuditEntry) computeHash() string {
+	entry.Hash = ""
+	j, _ := json.Marshal(entry)
+	h := sha256.Sum256(j)
+	return hex.EncodeToString(h[:])
+}
+
+// AuditSink is where the audit log is written to (see the management package for implementations).
+type AuditSink interface {
+	Write(ctx context.Context, entry AuditEntry) error
+
+	// List returns the most recent entries, newest first
+	List(ctx context.Context, limit int) ([]AuditEntry, error)
+}
+
+// VerifyAuditLog checks that the given entries (newest first, as returned by AuditSink.List) were not tampered with.
+func VerifyAuditLog(entries []AuditEntry) error {
+	for i, entry := range entries {
+		if entry.computeHash() != entry.Hash {
+			return fmt.Errorf("entry %s was modified", entry.Hash)
+		}
+		if i+1 < len(entries) && entries[i+1].Hash != entry.Previous {
+			return fmt.Errorf("entry before %s is missing", entry.Hash)
+		}
+	}
+	return nil
+}
+
+// ListAuditLog is the "listauditlog" management method, which takes an optional limit.
+type ListAuditLog struct {
+	Limit int
+}
+
+func (ListAuditLog) MethodName() string { return "listauditlog" }
+
+func decodeListAuditLog(params []any) (ListAuditLog, error) {
+	mp := ListAuditLog{Limit: 100}
+	if len(params) > 0 {
+		limit, ok := params[0].(float64)
+		if !ok || limit < 1 {
+			return mp, fmt.Errorf("limit must be a positive number")
+		}
+		mp.Limit = int(limit)
+	}
+	return mp, nil
+}
+
+// audit writes an entry to all the sinks, chained to the previous one
+func (rl *Relay) audit(ctx context.Context, pubkey string, req nip86.Request, resp nip86.Response) {
+	sinks := rl.ManagementAPI.AuditLog
+	if len(sinks) == 0 {
+		return
+	}
+
+	rl.auditMutex.Lock()
+	defer rl.auditMutex.Unlock()
+
+	// continue from where we stopped the last time the relay was running
+	if !rl.auditLoaded {
+		if last, err := sinks[0].List(ctx, 1); err != nil {
+			rl.Log.Printf("failed to load audit log: %v\n", err)
+			return
+		} else if len(last) > 0 {
+			rl.auditLast = last[0].Hash
+		}
+		rl.auditLoaded = true
+	}
+
+	entry := AuditEntry{
+		Timestamp: nostr.Now(),
+		PubKey:    pubkey,
+		Method:    req.Method,
+		Error:     resp.Error,
+		Previous:  rl.auditLast,
+	}
+	entry.Params, _ = json.Marshal(req.Params)
+	if resp.Result != nil {
+		entry.Result, _ = json.Marshal(resp.Result)
+	}
+	entry.Hash = entry.computeHash()
+
+	for _, sink := range sinks {
+		if err := sink.Write(ctx, entry); err != nil {
+			rl.Log.Printf("failed to write to audit log: %v\n", err)
+		}
+	}
+	rl.auditLast = entry.Hash
+}
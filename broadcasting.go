@@ -5,7 +5,10 @@ import (
 )
 
 // BroadcastEvent emits an event to all listeners whose filters' match, skipping all filters and actions
-// it also doesn't attempt to store the event or trigger any reactions or callbacks
+// it also doesn't attempt to store the event or trigger any reactions or callbacks.
+// if there is a Broker the event is also sent to the other instances, but only local listeners are counted.
 func (rl *Relay) BroadcastEvent(evt *nostr.Event) int {
-	return rl.notifyListeners(evt)
+	n := rl.notifyListeners(evt)
+	rl.publishToBroker(evt)
+	return n
 }
@@ -0,0 +1,53 @@
+package khatru
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Broker connects multiple instances of a relay (generally running behind a load balancer and sharing a
+// database) so the events accepted by any of them reach the subscribers connected to all the others.
+//
+// see the broker package for implementations.
+type Broker interface {
+	// Publish is called with every event that is broadcasted by this relay, including ephemeral events.
+	Publish(ctx context.Context, event *nostr.Event) error
+
+	// Subscribe is called once, when the relay starts being used, with a function that must be called
+	// for every event published by the other instances.
+	Subscribe(ctx context.Context, receive func(event *nostr.Event)) error
+}
+
+// begin is called whenever the relay is used, as only then we know all the options were set
+func (rl *Relay) begin() {
+	rl.expirationManager.begin()
+
+	if rl.Broker != nil {
+		rl.brokerOnce.Do(func() {
+			if err := rl.Broker.Subscribe(context.Background(), rl.receiveFromBroker); err != nil {
+				rl.Log.Printf("failed to subscribe to broker: %v\n", err)
+			}
+		})
+	}
+}
+
+func (rl *Relay) publishToBroker(evt *nostr.Event) {
+	if rl.Broker == nil {
+		return
+	}
+
+	rl.begin()
+	if err := rl.Broker.Publish(context.Background(), evt); err != nil {
+		rl.Log.Printf("failed to publish %s to broker: %v\n", evt.ID, err)
+	}
+}
+
+// events coming from other instances are only dispatched to our listeners, everything else was already done,
+func (rl *Relay) receiveFromBroker(evt *nostr.Event) {
+	// except for remembering requests to vanish, as that is not in the database
+	if evt.Kind == 62 && rl.isVanishRequestForUs(context.Background(), evt) {
+		rl.rememberVanished(evt)
+	}
+	rl.notifyListeners(evt)
+}
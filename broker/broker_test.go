@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+// startInstances starts one relay for each broker, all sharing the same database, and connects a client to each
+func startInstances(t *testing.T, brokers ...khatru.Broker) []*nostr.Relay {
+	store := &slicestore.SliceStore{}
+	store.Init()
+
+	clients := make([]*nostr.Relay, len(brokers))
+	for i, broker := range brokers {
+		relay := khatru.NewRelay()
+		relay.Broker = broker
+		relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+
+		server := httptest.NewServer(relay)
+		t.Cleanup(server.Close)
+
+		client, err := nostr.RelayConnect(context.Background(), "ws"+server.URL[4:])
+		require.NoError(t, err)
+		clients[i] = client
+	}
+	return clients
+}
+
+// checkFanOut publishes a normal and an ephemeral event to each instance and checks that all the others get them
+func checkFanOut(t *testing.T, clients []*nostr.Relay) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	subs := make([]*nostr.Subscription, len(clients))
+	for i, client := range clients {
+		sub, err := client.Subscribe(ctx, nostr.Filters{{Kinds: []int{1, 20001}}})
+		require.NoError(t, err)
+		<-sub.EndOfStoredEvents
+		subs[i] = sub
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	for i, client := range clients {
+		for _, kind := range []int{1, 20001} {
+			evt := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Content: fmt.Sprintf("hello from %d", i)}
+			evt.Sign(sk)
+			require.NoError(t, client.Publish(ctx, evt))
+
+			for j, sub := range subs {
+				select {
+				case got := <-sub.Events:
+					require.Equal(t, evt.ID, got.ID, "instance %d didn't get event from %d", j, i)
+				case <-ctx.Done():
+					t.Fatalf("instance %d didn't get event from %d", j, i)
+				}
+			}
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	local := NewLocal()
+	checkFanOut(t, startInstances(t, local.Member(), local.Member(), local.Member()))
+}
+
+func TestMesh(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			dir := t.TempDir()
+			meshes := make([]*Mesh, 3)
+			for i := range meshes {
+				address := "127.0.0.1:0"
+				if network == "unix" {
+					address = filepath.Join(dir, string(rune('a'+i))+".sock")
+				}
+
+				mesh, err := NewMesh(network, address)
+				require.NoError(t, err)
+				t.Cleanup(func() { mesh.Close() })
+				meshes[i] = mesh
+			}
+
+			brokers := make([]khatru.Broker, len(meshes))
+			for i, mesh := range meshes {
+				for j, other := range meshes {
+					if i != j {
+						mesh.AddPeer(other.Addr().String())
+					}
+				}
+				brokers[i] = mesh
+			}
+
+			checkFanOut(t, startInstances(t, brokers...))
+		})
+	}
+}
+
+func TestMeshRejectsForgedEvents(t *testing.T) {
+	mesh, err := NewMesh("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer mesh.Close()
+
+	received := make(chan *nostr.Event, 3)
+	mesh.Subscribe(context.Background(), func(event *nostr.Event) { received <- event })
+
+	conn, err := net.Dial("tcp", mesh.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	send := func(evt nostr.Event) {
+		j, _ := json.Marshal(evt)
+		conn.Write(append(j, '\n'))
+	}
+
+	forged := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "original"}
+	forged.Sign(sk)
+	forged.Content = "changed"
+	send(forged)
+
+	unsigned := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "unsigned"}
+	unsigned.Sign(sk)
+	unsigned.Sig = strings.Repeat("0", 128)
+	send(unsigned)
+
+	valid := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "valid"}
+	valid.Sign(sk)
+	send(valid)
+
+	select {
+	case evt := <-received:
+		require.Equal(t, valid.ID, evt.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("didn't get the valid event")
+	}
+	require.Len(t, received, 0)
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Local connects relays that live in the same process.
+type Local struct {
+	mu      sync.RWMutex
+	members []*localMember
+}
+
+func NewLocal() *Local {
+	return &Local{
+		members: make([]*localMember, 0, 2),
+	}
+}
+
+// Member returns a new khatru.Broker to be used by one of the relays, events published by it will
+// be received by all the other members.
+func (l *Local) Member() khatru.Broker {
+	m := &localMember{local: l}
+	l.mu.Lock()
+	l.members = append(l.members, m)
+	l.mu.Unlock()
+	return m
+}
+
+type localMember struct {
+	local   *Local
+	receive func(event *nostr.Event)
+}
+
+func (m *localMember) Publish(ctx context.Context, event *nostr.Event) error {
+	m.local.mu.RLock()
+	defer m.local.mu.RUnlock()
+
+	for _, other := range m.local.members {
+		if other != m && other.receive != nil {
+			other.receive(event)
+		}
+	}
+	return nil
+}
+
+func (m *localMember) Subscribe(ctx context.Context, receive func(event *nostr.Event)) error {
+	m.local.mu.Lock()
+	m.receive = receive
+	m.local.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var ErrPeerQueueFull = errors.New("peer queue is full")
+
+// Mesh connects relays running in different processes (or machines) over TCP or Unix sockets.
+//
+// Each instance listens on its own address and sends the events it publishes directly to all of its
+// peers, events are never forwarded, so every instance must have all the others as peers.
+// Anyone who can connect can send events, so their ids and signatures are checked again, but the
+// connections should still only be reachable from a private network.
+type Mesh struct {
+	// QueueSize is the number of events that can be waiting to be sent to a single peer (while it's
+	// slow or unreachable) before new ones start being dropped. Must be set before adding peers.
+	QueueSize int
+
+	Log *log.Logger
+
+	network  string
+	listener net.Listener
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	peers   map[string]*meshPeer
+	inbound map[net.Conn]struct{}
+	receive func(event *nostr.Event)
+}
+
+// NewMesh starts listening on the given address right away, network is either "tcp" or "unix".
+func NewMesh(network string, address string, peers ...string) (*Mesh, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mesh{
+		QueueSize: 1000,
+		Log:       log.New(os.Stderr, "[khatru-mesh] ", log.LstdFlags),
+
+		network:  network,
+		listener: listener,
+		ctx:      ctx,
+		cancel:   cancel,
+		peers:    make(map[string]*meshPeer, len(peers)),
+		inbound:  make(map[net.Conn]struct{}),
+	}
+
+	go m.accept()
+
+	for _, peer := range peers {
+		m.AddPeer(peer)
+	}
+
+	return m, nil
+}
+
+// Addr is the address this instance is listening on (useful when it was started on port 0).
+func (m *Mesh) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// AddPeer starts sending events to another instance, the connection is retried until it succeeds.
+func (m *Mesh) AddPeer(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.peers[address]; ok {
+		return
+	}
+
+	peer := &meshPeer{
+		mesh:    m,
+		address: address,
+		queue:   make(chan []byte, max(m.QueueSize, 1)),
+	}
+	m.peers[address] = peer
+	go peer.run()
+}
+
+// Close stops listening and disconnects from all peers.
+func (m *Mesh) Close() error {
+	m.cancel()
+	err := m.listener.Close()
+
+	m.mu.Lock()
+	for conn := range m.inbound {
+		conn.Close()
+	}
+	m.mu.Unlock()
+
+	return err
+}
+
+func (m *Mesh) Publish(ctx context.Context, event *nostr.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, peer := range m.peers {
+		select {
+		case peer.queue <- data:
+		default:
+			errs = append(errs, fmt.Errorf("%w: %s", ErrPeerQueueFull, peer.address))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mesh) Subscribe(ctx context.Context, receive func(event *nostr.Event)) error {
+	m.mu.Lock()
+	m.receive = receive
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Mesh) accept() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if m.ctx.Err() == nil {
+				m.Log.Printf("failed to accept connection: %v\n", err)
+			}
+			return
+		}
+
+		m.mu.Lock()
+		m.inbound[conn] = struct{}{}
+		m.mu.Unlock()
+
+		go m.read(conn)
+	}
+}
+
+func (m *Mesh) read(conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.inbound, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		event := &nostr.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			m.Log.Printf("got invalid event from %s: %v\n", conn.RemoteAddr(), err)
+			continue
+		}
+		if !event.CheckID() {
+			m.Log.Printf("got event with wrong id from %s\n", conn.RemoteAddr())
+			continue
+		}
+		if ok, err := event.CheckSignature(); !ok {
+			m.Log.Printf("got event with invalid signature from %s: %v\n", conn.RemoteAddr(), err)
+			continue
+		}
+
+		m.mu.Lock()
+		receive := m.receive
+		m.mu.Unlock()
+
+		if receive != nil {
+			receive(event)
+		}
+	}
+}
+
+type meshPeer struct {
+	mesh    *Mesh
+	address string
+	queue   chan []byte
+}
+
+func (p *meshPeer) run() {
+	backoff := 100 * time.Millisecond
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+
+	for {
+		conn, err := dialer.DialContext(p.mesh.ctx, p.mesh.network, p.address)
+		if err != nil {
+			select {
+			case <-p.mesh.ctx.Done():
+				return
+			case <-time.After(backoff):
+				backoff = min(backoff*2, 10*time.Second)
+				continue
+			}
+		}
+		backoff = 100 * time.Millisecond
+
+		if err := p.write(conn); err != nil {
+			p.mesh.Log.Printf("lost connection to peer %s: %v\n", p.address, err)
+		}
+		conn.Close()
+
+		if p.mesh.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// write sends queued events to the peer until the connection fails or the mesh is closed
+func (p *meshPeer) write(conn net.Conn) error {
+	// the peer never sends anything, so this is how we notice it went away before losing an event
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case <-p.mesh.ctx.Done():
+			return nil
+		case <-gone:
+			return io.EOF
+		case data := <-p.queue:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+}
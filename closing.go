@@ -0,0 +1,70 @@
+package khatru
+
+import (
+	"errors"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var ErrSubscriptionClosedByRelay = errors.New("subscription closed by relay")
+
+// CloseSubscription ends a client subscription from the relay side, sending a CLOSED message
+// with the given reason. It returns false if there was no such subscription.
+func (rl *Relay) CloseSubscription(ws *WebSocket, id string, reason string) bool {
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	_, exists := ws.subscriptions[id]
+	rl.removeListenerIdLocked(shard, ws, id, ErrSubscriptionClosedByRelay)
+	shard.clientsMutex.Unlock()
+
+	if exists {
+		ws.WriteJSON(nostr.ClosedEnvelope{
+			SubscriptionID: id,
+			Reason:         nostr.NormalizeOKMessage(reason, "error"),
+		})
+	}
+	return exists
+}
+
+// Disconnect closes a client connection from the relay side, the reason is sent along with the
+// websocket close message. The OnDisconnect hooks will be called as usual.
+func (rl *Relay) Disconnect(ws *WebSocket, reason string) {
+	ws.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(time.Second))
+	ws.cancel()
+
+	// this will cause the read loop to stop and everything else to be cleaned up
+	ws.conn.Close()
+}
+
+// GetConnections returns all the clients currently connected to this relay.
+func (rl *Relay) GetConnections() []*WebSocket {
+	return rl.findConnections(func(ws *WebSocket) bool { return true })
+}
+
+// GetConnectionsByIP returns all the clients currently connected from the given IP.
+func (rl *Relay) GetConnectionsByIP(ip string) []*WebSocket {
+	return rl.findConnections(func(ws *WebSocket) bool { return GetIPFromRequest(ws.Request) == ip })
+}
+
+// GetConnectionsByAuthed returns all the clients that have authenticated as the given pubkey.
+func (rl *Relay) GetConnectionsByAuthed(pubkey string) []*WebSocket {
+	return rl.findConnections(func(ws *WebSocket) bool { return pubkey != "" && ws.AuthedPublicKey == pubkey })
+}
+
+func (rl *Relay) findConnections(match func(ws *WebSocket) bool) []*WebSocket {
+	res := make([]*WebSocket, 0, 4)
+	for _, shard := range rl.shards {
+		shard.clientsMutex.Lock()
+		for ws := range shard.clients {
+			if match(ws) {
+				res = append(res, ws)
+			}
+		}
+		shard.clientsMutex.Unlock()
+	}
+	return res
+}
@@ -2,7 +2,9 @@ package khatru
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -11,6 +13,26 @@ import (
 
 func (rl *Relay) handleDeleteRequest(ctx context.Context, evt *nostr.Event) error {
 	// event deletion -- nip09
+
+	// the "k" tags, when present, say what kinds of events are being deleted
+	var kinds []int
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "k" {
+			kind, err := strconv.Atoi(tag[1])
+			if err != nil {
+				return fmt.Errorf("invalid: bad \"k\" tag '%s'", tag[1])
+			}
+			kinds = append(kinds, kind)
+		}
+	}
+	if slices.Contains(kinds, 5) {
+		return errors.New("invalid: deletion requests can't be deleted")
+	}
+
+	// first we gather everything that will be deleted so we either delete all or nothing
+	ctx = context.WithValue(ctx, internalCallKey, struct{}{})
+	targets := make([]*nostr.Event, 0, len(evt.Tags))
+	seen := make(map[string]struct{}, len(evt.Tags))
 	for _, tag := range evt.Tags {
 		if len(tag) >= 2 {
 			var f nostr.Filter
@@ -32,54 +54,178 @@ func (rl *Relay) handleDeleteRequest(ctx context.Context, evt *nostr.Event) erro
 				f = nostr.Filter{
 					Kinds:   []int{kind},
 					Authors: []string{author},
-					Tags:    nostr.TagMap{"d": []string{identifier}},
 					Until:   &evt.CreatedAt,
 				}
+				if nostr.IsAddressableKind(kind) {
+					// only addressable events have a "d" tag, replaceable ones are identified by kind and author
+					f.Tags = nostr.TagMap{"d": []string{identifier}}
+				}
 			default:
 				continue
 			}
 
-			ctx := context.WithValue(ctx, internalCallKey, struct{}{})
+			// there may be more than one version of the same address (or the same event in more than one store)
 			for _, query := range rl.QueryEvents {
 				ch, err := query(ctx, f)
 				if err != nil {
 					continue
 				}
-				target := <-ch
-				if target == nil {
-					continue
+				for target := range ch {
+					if _, ok := seen[target.ID]; ok {
+						continue
+					}
+					seen[target.ID] = struct{}{}
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+
+	for _, target := range targets {
+		if target.Kind == 5 {
+			return errors.New("invalid: deletion requests can't be deleted")
+		}
+		if kinds != nil && !slices.Contains(kinds, target.Kind) {
+			return fmt.Errorf("invalid: event %s is of kind %d, which isn't in the \"k\" tags", target.ID, target.Kind)
+		}
+
+		// check if the user can delete it
+		acceptDeletion := target.PubKey == evt.PubKey
+		var msg string
+		if !acceptDeletion {
+			msg = "you are not the author of this event"
+		}
+		// but if we have a function to overwrite this outcome, use that instead
+		for _, odo := range rl.OverwriteDeletionOutcome {
+			acceptDeletion, msg = odo(ctx, target, evt)
+		}
+
+		if !acceptDeletion {
+			// fail and stop here
+			return fmt.Errorf("blocked: %s", msg)
+		}
+	}
+
+	for _, target := range targets {
+		// delete it
+		for _, del := range rl.DeleteEvent {
+			if err := del(ctx, target); err != nil {
+				return err
+			}
+		}
+
+		// if it was tracked to be expired that is not needed anymore
+		rl.expirationManager.removeEvent(target.ID)
+	}
+
+	return nil
+}
+
+// handleVanishRequest deletes everything from the author of a "request to vanish" -- nip62
+func (rl *Relay) handleVanishRequest(ctx context.Context, evt *nostr.Event) error {
+	if !rl.isVanishRequestForUs(ctx, evt) {
+		return nil
+	}
+	rl.rememberVanished(evt)
+
+	ctx = context.WithValue(ctx, internalCallKey, struct{}{})
+	for _, f := range []nostr.Filter{
+		// all their events
+		{Authors: []string{evt.PubKey}, Until: &evt.CreatedAt},
+		// and the gift wraps sent to them
+		{Kinds: []int{1059}, Tags: nostr.TagMap{"p": []string{evt.PubKey}}, Until: &evt.CreatedAt},
+	} {
+		for _, query := range rl.QueryEvents {
+			// stores only give us a page at a time, so we keep deleting until nothing is left
+			f.Limit = scanPage
+			deleted := make(map[string]struct{})
+			for len(rl.DeleteEvent) > 0 {
+				ch, err := query(ctx, f)
+				if err != nil {
+					break
 				}
-				// got the event, now check if the user can delete it
-				acceptDeletion := target.PubKey == evt.PubKey
-				var msg string
-				if !acceptDeletion {
-					msg = "you are not the author of this event"
+
+				// get everything before deleting so we don't mess with the query
+				targets := make([]*nostr.Event, 0, 100)
+				for target := range ch {
+					if _, ok := deleted[target.ID]; !ok {
+						targets = append(targets, target)
+					}
 				}
-				// but if we have a function to overwrite this outcome, use that instead
-				for _, odo := range rl.OverwriteDeletionOutcome {
-					acceptDeletion, msg = odo(ctx, target, evt)
+				if len(targets) == 0 {
+					// either everything is gone or the store isn't really deleting
+					break
 				}
 
-				if acceptDeletion {
-					// delete it
+				for _, target := range targets {
 					for _, del := range rl.DeleteEvent {
 						if err := del(ctx, target); err != nil {
-							return err
+							return fmt.Errorf("error: failed to delete %s: %w", target.ID, err)
 						}
 					}
-
-					// if it was tracked to be expired that is not needed anymore
 					rl.expirationManager.removeEvent(target.ID)
-				} else {
-					// fail and stop here
-					return fmt.Errorf("blocked: %s", msg)
+					deleted[target.ID] = struct{}{}
 				}
-
-				// don't try to query this same event again
-				break
 			}
 		}
 	}
 
 	return nil
 }
+
+// vanishRequest is the latest request to vanish we got from someone
+type vanishRequest struct {
+	id        string
+	createdAt nostr.Timestamp
+}
+
+// hasVanished tells if the author of an event has requested to vanish from this relay after it was created
+func (rl *Relay) hasVanished(ctx context.Context, evt *nostr.Event) bool {
+	rl.vanishedOnce.Do(func() { rl.loadVanished(ctx) })
+
+	request, ok := rl.vanished.Load(evt.PubKey)
+	return ok && request.id != evt.ID && evt.CreatedAt <= request.createdAt
+}
+
+// loadVanished finds all the requests to vanish that were stored before, so we don't have to query for
+// them every time an event is published
+func (rl *Relay) loadVanished(ctx context.Context) {
+	ctx = context.WithValue(ctx, internalCallKey, struct{}{})
+	for _, query := range rl.QueryEvents {
+		scanAll(ctx, query, nostr.Filter{Kinds: []int{62}}, func(request *nostr.Event) {
+			if rl.isVanishRequestForUs(ctx, request) {
+				rl.rememberVanished(request)
+			}
+		})
+	}
+}
+
+func (rl *Relay) rememberVanished(request *nostr.Event) {
+	rl.vanished.Compute(request.PubKey, func(old vanishRequest, loaded bool) (vanishRequest, bool) {
+		if loaded && old.createdAt >= request.CreatedAt {
+			return old, false
+		}
+		return vanishRequest{id: request.ID, createdAt: request.CreatedAt}, false
+	})
+}
+
+func (rl *Relay) isVanishRequestForUs(ctx context.Context, evt *nostr.Event) bool {
+	ourURL := rl.ServiceURL
+	if ourURL == "" {
+		if ws := GetConnection(ctx); ws != nil && ws.Request != nil {
+			ourURL = rl.getBaseURL(ws.Request)
+		}
+	}
+
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "relay" {
+			if tag[1] == "ALL_RELAYS" {
+				return true
+			}
+			if ourURL != "" && nostr.NormalizeURL(tag[1]) == nostr.NormalizeURL(ourURL) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package khatru
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteRequest(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	base := nostr.Now() - 100
+
+	// two stores, so we can see events being deleted from all of them
+	setup := func() (*Relay, []*slicestore.SliceStore) {
+		relay := NewRelay()
+		stores := []*slicestore.SliceStore{{}, {}}
+		for _, store := range stores {
+			store.Init()
+			relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+			relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent)
+		}
+		return relay, stores
+	}
+	create := func(kind int, createdAt nostr.Timestamp, tags nostr.Tags) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: tags}
+		evt.Sign(sk)
+		return evt
+	}
+	count := func(store *slicestore.SliceStore, filter nostr.Filter) int {
+		n, _ := store.CountEvents(ctx, filter)
+		return int(n)
+	}
+
+	t.Run("every version of an address", func(t *testing.T) {
+		relay, stores := setup()
+		for i, store := range stores {
+			// leftover versions that should have been replaced, plus one that is newer than the deletion
+			store.SaveEvent(ctx, create(30023, base+nostr.Timestamp(i), nostr.Tags{{"d", "x"}}))
+			store.SaveEvent(ctx, create(30023, base+10+nostr.Timestamp(i), nostr.Tags{{"d", "x"}}))
+			store.SaveEvent(ctx, create(30023, base+50, nostr.Tags{{"d", "x"}}))
+		}
+
+		deletion := create(5, base+20, nostr.Tags{{"a", "30023:" + pk + ":x"}, {"k", "30023"}})
+		require.NoError(t, relay.handleDeleteRequest(ctx, deletion))
+		for _, store := range stores {
+			require.Equal(t, 1, count(store, nostr.Filter{Kinds: []int{30023}}))
+			require.Equal(t, 1, count(store, nostr.Filter{Kinds: []int{30023}, Since: &deletion.CreatedAt}))
+		}
+	})
+
+	t.Run("replaceable events by address", func(t *testing.T) {
+		relay, stores := setup()
+		for i, store := range stores {
+			store.SaveEvent(ctx, create(10002, base+nostr.Timestamp(i), nil))
+			store.SaveEvent(ctx, create(10002, base+50, nil))
+		}
+
+		deletion := create(5, base+20, nostr.Tags{{"a", "10002:" + pk + ":"}, {"k", "10002"}})
+		require.NoError(t, relay.handleDeleteRequest(ctx, deletion))
+		for _, store := range stores {
+			require.Equal(t, 1, count(store, nostr.Filter{Kinds: []int{10002}}))
+			require.Equal(t, 1, count(store, nostr.Filter{Kinds: []int{10002}, Since: &deletion.CreatedAt}))
+		}
+	})
+
+	t.Run("k tags must match", func(t *testing.T) {
+		relay, stores := setup()
+		note := create(1, base, nil)
+		stores[0].SaveEvent(ctx, note)
+
+		err := relay.handleDeleteRequest(ctx, create(5, base+1, nostr.Tags{{"e", note.ID}, {"k", "7"}}))
+		require.ErrorContains(t, err, "invalid:")
+		require.Equal(t, 1, count(stores[0], nostr.Filter{IDs: []string{note.ID}}))
+
+		err = relay.handleDeleteRequest(ctx, create(5, base+1, nostr.Tags{{"e", note.ID}, {"k", "7"}, {"k", "1"}}))
+		require.NoError(t, err)
+		require.Equal(t, 0, count(stores[0], nostr.Filter{IDs: []string{note.ID}}))
+	})
+
+	t.Run("deletion requests can't be deleted", func(t *testing.T) {
+		relay, stores := setup()
+		note := create(1, base, nil)
+		previous := create(5, base+1, nostr.Tags{{"e", "0000000000000000000000000000000000000000000000000000000000000000"}})
+		stores[0].SaveEvent(ctx, note)
+		stores[0].SaveEvent(ctx, previous)
+
+		// nothing is deleted, not even the other targets
+		err := relay.handleDeleteRequest(ctx, create(5, base+2, nostr.Tags{{"e", note.ID}, {"e", previous.ID}}))
+		require.ErrorContains(t, err, "invalid:")
+		require.Equal(t, 2, count(stores[0], nostr.Filter{}))
+
+		err = relay.handleDeleteRequest(ctx, create(5, base+2, nostr.Tags{{"e", note.ID}, {"k", "5"}}))
+		require.ErrorContains(t, err, "invalid:")
+		require.Equal(t, 2, count(stores[0], nostr.Filter{}))
+	})
+}
+
+func TestVanishRequest(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	other := nostr.GeneratePrivateKey()
+	base := nostr.Now() - 100
+
+	relay := NewRelay()
+	relay.ServiceURL = "wss://relay.example.com"
+	store := &slicestore.SliceStore{}
+	store.Init()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent)
+
+	create := func(sk string, kind int, createdAt nostr.Timestamp, tags nostr.Tags) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: tags}
+		evt.Sign(sk)
+		return evt
+	}
+	ids := func() []string {
+		ch, _ := store.QueryEvents(ctx, nostr.Filter{})
+		ids := make([]string, 0, 5)
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	note := create(sk, 1, base, nil)
+	profile := create(sk, 0, base+1, nil)
+	giftwrap := create(other, 1059, base+2, nostr.Tags{{"p", pk}})
+	othersNote := create(other, 1, base+3, nil)
+	newer := create(sk, 1, base+50, nil)
+	for _, evt := range []*nostr.Event{note, profile, giftwrap, othersNote, newer} {
+		store.SaveEvent(ctx, evt)
+	}
+
+	// addressed to some other relay
+	elsewhere := create(sk, 62, base+10, nostr.Tags{{"relay", "wss://other.example.com"}})
+	require.NoError(t, relay.handleVanishRequest(ctx, elsewhere))
+	require.Len(t, ids(), 5)
+
+	// addressed to us
+	request := create(sk, 62, base+10, nostr.Tags{{"relay", "wss://relay.example.com/"}})
+	require.NoError(t, relay.handleVanishRequest(ctx, request))
+	require.ElementsMatch(t, []string{othersNote.ID, newer.ID}, ids())
+	_, err := relay.AddEvent(ctx, request)
+	require.NoError(t, err)
+
+	// their old events can't come back
+	_, err = relay.AddEvent(ctx, note)
+	require.ErrorContains(t, err, "blocked:")
+	_, err = relay.AddEvent(ctx, create(sk, 1, base+9, nil))
+	require.ErrorContains(t, err, "blocked:")
+
+	// but new ones can
+	_, err = relay.AddEvent(ctx, create(sk, 1, base+11, nil))
+	require.NoError(t, err)
+
+	// ALL_RELAYS also works
+	everywhere := create(sk, 62, base+60, nostr.Tags{{"relay", "ALL_RELAYS"}})
+	require.NoError(t, relay.handleVanishRequest(ctx, everywhere))
+	require.ElementsMatch(t, []string{othersNote.ID}, ids())
+	_, err = relay.AddEvent(ctx, everywhere)
+	require.NoError(t, err)
+
+	// everything goes, even when it doesn't fit in a single query
+	prolific := nostr.GeneratePrivateKey()
+	prolificPK, _ := nostr.GetPublicKey(prolific)
+	for i := range 1200 {
+		note := &nostr.Event{CreatedAt: base + nostr.Timestamp(i%30), Kind: 1, Content: strconv.Itoa(i)}
+		note.Sign(prolific)
+		store.SaveEvent(ctx, note)
+		if i%2 == 0 {
+			giftwrap := &nostr.Event{CreatedAt: note.CreatedAt, Kind: 1059, Content: note.Content, Tags: nostr.Tags{{"p", prolificPK}}}
+			giftwrap.Sign(other)
+			store.SaveEvent(ctx, giftwrap)
+		}
+	}
+	require.NoError(t, relay.handleVanishRequest(ctx, create(prolific, 62, base+40, nostr.Tags{{"relay", "ALL_RELAYS"}})))
+	left, _ := store.CountEvents(ctx, nostr.Filter{Authors: []string{prolificPK}})
+	require.Zero(t, left)
+	left, _ = store.CountEvents(ctx, nostr.Filter{Kinds: []int{1059}, Tags: nostr.TagMap{"p": []string{prolificPK}}})
+	require.Zero(t, left)
+	require.ElementsMatch(t, []string{othersNote.ID, everywhere.ID}, ids())
+
+	// after a restart the stored requests are loaded once, not queried for every event
+	restarted := NewRelay()
+	restarted.ServiceURL = relay.ServiceURL
+	vanishQueries := 0
+	restarted.StoreEvent = append(restarted.StoreEvent, store.SaveEvent)
+	restarted.QueryEvents = append(restarted.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if slices.Contains(filter.Kinds, 62) {
+			vanishQueries++
+		}
+		return store.QueryEvents(ctx, filter)
+	})
+	_, err = restarted.AddEvent(ctx, create(sk, 1, base+59, nil))
+	require.ErrorContains(t, err, "blocked:")
+	loading := vanishQueries
+	_, err = restarted.AddEvent(ctx, create(sk, 1, base+61, nil))
+	require.NoError(t, err)
+	_, err = restarted.AddEvent(ctx, create(other, 1, base+20, nil))
+	require.NoError(t, err)
+	require.Equal(t, loading, vanishQueries)
+}
@@ -19,6 +19,7 @@ export default {
           { text: 'HTTP Integration', link: '/core/embed' },
           { text: 'Request Routing', link: '/core/routing' },
           { text: 'Management API', link: '/core/management' },
+          { text: 'Multiple Instances', link: '/core/broker' },
           { text: 'Media Storage (Blossom)', link: '/core/blossom' },
         ]
       },
@@ -8,6 +8,10 @@ import (
 )
 
 func (rl *Relay) handleEphemeral(ctx context.Context, evt *nostr.Event) error {
+	if isExpired(evt) {
+		return errors.New("invalid: event is expired")
+	}
+
 	for _, reject := range rl.RejectEvent {
 		if reject, msg := reject(ctx, evt); reject {
 			if msg == "" {
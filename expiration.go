@@ -3,6 +3,8 @@ package khatru
 import (
 	"container/heap"
 	"context"
+	"errors"
+	"math"
 	"sync"
 	"time"
 
@@ -15,107 +17,259 @@ type expiringEvent struct {
 	expiresAt nostr.Timestamp
 }
 
-type expiringEventHeap []expiringEvent
+// expiringEventHeap keeps track of the position of each event so they can be removed quickly
+type expiringEventHeap struct {
+	items []expiringEvent
+	index map[string]int
+}
 
-func (h expiringEventHeap) Len() int           { return len(h) }
-func (h expiringEventHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
-func (h expiringEventHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiringEventHeap) Len() int           { return len(h.items) }
+func (h *expiringEventHeap) Less(i, j int) bool { return h.items[i].expiresAt < h.items[j].expiresAt }
+func (h *expiringEventHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].id] = i
+	h.index[h.items[j].id] = j
+}
 
 func (h *expiringEventHeap) Push(x interface{}) {
-	*h = append(*h, x.(expiringEvent))
+	item := x.(expiringEvent)
+	h.index[item.id] = len(h.items)
+	h.items = append(h.items, item)
 }
 
 func (h *expiringEventHeap) Pop() interface{} {
-	old := *h
+	old := h.items
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.items = old[0 : n-1]
+	delete(h.index, x.id)
 	return x
 }
 
 type expirationManager struct {
-	events          expiringEventHeap
-	mu              sync.Mutex
-	relay           *Relay
-	interval        time.Duration
-	initialScanDone bool
+	events   expiringEventHeap
+	mu       sync.Mutex
+	relay    *Relay
+	interval time.Duration // the longest we'll sleep before checking again
+
+	// when we have to go through all the events at startup we stop after this many of them from each
+	// store, and we wait a bit between pages so the relay isn't kept busy by this
+	scanLimit int
+	scanPause time.Duration
+
+	ready   chan struct{} // closed when the relay starts being used
+	kickoff sync.Once
+	wake    chan struct{} // signaled when an event that expires sooner than all others is tracked
 }
 
 func newExpirationManager(relay *Relay) *expirationManager {
 	return &expirationManager{
-		events:   make(expiringEventHeap, 0),
-		relay:    relay,
-		interval: time.Hour,
+		events: expiringEventHeap{
+			items: make([]expiringEvent, 0),
+			index: make(map[string]int),
+		},
+		relay:     relay,
+		interval:  time.Hour,
+		scanLimit: 100_000,
+		scanPause: 100 * time.Millisecond,
+		ready:     make(chan struct{}),
+		wake:      make(chan struct{}, 1),
 	}
 }
 
+// begin is called whenever the relay is used, as only then we can be sure its stores were set up
+func (em *expirationManager) begin() {
+	em.kickoff.Do(func() { close(em.ready) })
+}
+
 func (em *expirationManager) start(ctx context.Context) {
-	ticker := time.NewTicker(em.interval)
-	defer ticker.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-em.ready:
+	}
+
+	em.initialScan(ctx)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			if !em.initialScanDone {
-				em.initialScan(ctx)
-				em.initialScanDone = true
-			}
-
+		case <-em.wake:
+		case <-timer.C:
 			em.checkExpiredEvents(ctx)
 		}
+
+		timer.Reset(em.untilNext())
 	}
 }
 
-func (em *expirationManager) initialScan(ctx context.Context) {
+// untilNext is how long we can sleep until the next event expires
+func (em *expirationManager) untilNext() time.Duration {
 	em.mu.Lock()
 	defer em.mu.Unlock()
 
-	// query all events
+	if em.events.Len() == 0 {
+		return em.interval
+	}
+	return min(max(time.Until(em.events.items[0].expiresAt.Time()), 0), em.interval)
+}
+
+func (em *expirationManager) initialScan(ctx context.Context) {
 	ctx = context.WithValue(ctx, internalCallKey, struct{}{})
-	for _, query := range em.relay.QueryEvents {
-		ch, err := query(ctx, nostr.Filter{})
+
+	found := make([]expiringEvent, 0)
+	collect := func(evt *nostr.Event) {
+		if expiresAt := nip40.GetExpiration(evt.Tags); expiresAt != -1 {
+			found = append(found, expiringEvent{
+				id:        evt.ID,
+				expiresAt: expiresAt,
+			})
+		}
+	}
+
+	// use the stores that can give us just the events with an "expiration" tag
+	for _, query := range em.relay.QueryExpiringEvents {
+		ch, err := query(ctx)
 		if err != nil {
 			continue
 		}
-
 		for evt := range ch {
-			if expiresAt := nip40.GetExpiration(evt.Tags); expiresAt != -1 {
-				heap.Push(&em.events, expiringEvent{
-					id:        evt.ID,
-					expiresAt: expiresAt,
-				})
+			collect(evt)
+		}
+	}
+
+	// otherwise we have to go through everything, or at least through the newest events
+	if len(em.relay.QueryExpiringEvents) == 0 {
+		for _, query := range em.relay.QueryEvents {
+			scanned := 0
+			throttled := func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+				if scanned >= em.scanLimit {
+					return nil, errScanLimit
+				}
+				if scanned > 0 {
+					select {
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					case <-time.After(em.scanPause):
+					}
+				}
+				return query(ctx, filter)
+			}
+			scanAll(ctx, throttled, nostr.Filter{}, func(evt *nostr.Event) {
+				scanned++
+				collect(evt)
+			})
+			if scanned >= em.scanLimit {
+				em.relay.Log.Printf("stopped looking for expiring events after the newest %d, older ones will be hidden when they expire but not deleted\n", scanned)
 			}
 		}
 	}
 
-	heap.Init(&em.events)
+	em.mu.Lock()
+	for _, item := range found {
+		em.track(item)
+	}
+	em.mu.Unlock()
 }
 
-func (em *expirationManager) checkExpiredEvents(ctx context.Context) {
-	em.mu.Lock()
-	defer em.mu.Unlock()
+// scanPage is how many events we ask for at a time when scanning everything
+const scanPage = 500
+
+var errScanLimit = errors.New("too many events to scan")
+
+// scanAll goes through all the events in a store that match the filter, from the newest to the oldest,
+// one page at a time, as most stores have a default limit when a filter doesn't have one
+func scanAll(
+	ctx context.Context,
+	query func(context.Context, nostr.Filter) (chan *nostr.Event, error),
+	filter nostr.Filter,
+	fn func(*nostr.Event),
+) {
+	var until *nostr.Timestamp
+	boundary := nostr.Timestamp(math.MaxInt64) // the oldest second we got so far
+	seen := make(map[string]struct{})          // the events we got from that second
+	for {
+		filter.Until = until
+		filter.Limit = scanPage
+		ch, err := query(ctx, filter)
+		if err != nil {
+			return
+		}
+
+		received := 0
+		fresh := 0
+		for evt := range ch {
+			received++
+			if until != nil && evt.CreatedAt > *until {
+				// this store doesn't know about "until", so we can't go any further
+				drain([]chan *nostr.Event{ch})
+				return
+			}
+			if _, ok := seen[evt.ID]; ok {
+				continue
+			}
+			fresh++
+			fn(evt)
+
+			if evt.CreatedAt < boundary {
+				boundary = evt.CreatedAt
+				clear(seen)
+			}
+			if evt.CreatedAt == boundary {
+				seen[evt.ID] = struct{}{}
+			}
+		}
+		if received == 0 || ctx.Err() != nil {
+			return
+		}
+
+		// the next page starts at the oldest second we got, as there may be more events in it,
+		// unless we only got events we had seen already
+		if fresh == 0 {
+			boundary--
+			clear(seen)
+		}
+		next := boundary
+		until = &next
+	}
+}
 
+func (em *expirationManager) checkExpiredEvents(ctx context.Context) {
 	now := nostr.Now()
 
-	// keep deleting events from the heap as long as they're expired
+	// take all the expired events from the heap
+	expired := make([]string, 0)
+	em.mu.Lock()
 	for em.events.Len() > 0 {
-		next := em.events[0]
+		next := em.events.items[0]
 		if now < next.expiresAt {
 			break
 		}
 
 		heap.Pop(&em.events)
+		expired = append(expired, next.id)
+	}
+	em.mu.Unlock()
 
-		ctx := context.WithValue(ctx, internalCallKey, struct{}{})
+	// then delete them from the stores
+	ctx = context.WithValue(ctx, internalCallKey, struct{}{})
+	for _, id := range expired {
 		for _, query := range em.relay.QueryEvents {
-			ch, err := query(ctx, nostr.Filter{IDs: []string{next.id}})
+			ch, err := query(ctx, nostr.Filter{IDs: []string{id}})
 			if err != nil {
 				continue
 			}
 
-			if evt := <-ch; evt != nil {
+			// let the store finish the query before we delete anything from it
+			evt := <-ch
+			for range ch {
+			}
+
+			if evt != nil {
 				for _, del := range em.relay.DeleteEvent {
 					del(ctx, evt)
 				}
@@ -127,24 +281,46 @@ func (em *expirationManager) checkExpiredEvents(ctx context.Context) {
 
 func (em *expirationManager) trackEvent(evt *nostr.Event) {
 	if expiresAt := nip40.GetExpiration(evt.Tags); expiresAt != -1 {
+		em.begin()
+
 		em.mu.Lock()
-		heap.Push(&em.events, expiringEvent{
+		em.track(expiringEvent{
 			id:        evt.ID,
 			expiresAt: expiresAt,
 		})
+		soonest := em.events.items[0].id == evt.ID
 		em.mu.Unlock()
+
+		if soonest {
+			select {
+			case em.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// track must be called with the lock held
+func (em *expirationManager) track(item expiringEvent) {
+	if i, ok := em.events.index[item.id]; ok {
+		em.events.items[i].expiresAt = item.expiresAt
+		heap.Fix(&em.events, i)
+	} else {
+		heap.Push(&em.events, item)
 	}
 }
 
+// isExpired tells if an event has an "expiration" tag that is already in the past
+func isExpired(evt *nostr.Event) bool {
+	expiresAt := nip40.GetExpiration(evt.Tags)
+	return expiresAt != -1 && expiresAt <= nostr.Now()
+}
+
 func (em *expirationManager) removeEvent(id string) {
 	em.mu.Lock()
 	defer em.mu.Unlock()
 
-	// Find and remove the event from the heap
-	for i := 0; i < len(em.events); i++ {
-		if em.events[i].id == id {
-			heap.Remove(&em.events, i)
-			break
-		}
+	if i, ok := em.events.index[id]; ok {
+		heap.Remove(&em.events, i)
 	}
 }
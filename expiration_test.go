@@ -0,0 +1,222 @@
+package khatru
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationHeapIndex(t *testing.T) {
+	em := newExpirationManager(NewRelay())
+
+	ids := make([]string, 200)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		em.trackEvent(&nostr.Event{ID: ids[i], Tags: nostr.Tags{{"expiration", strconv.Itoa(1000 + rand.Intn(100))}}})
+	}
+
+	// tracking the same event again just updates it
+	em.trackEvent(&nostr.Event{ID: ids[0], Tags: nostr.Tags{{"expiration", "999"}}})
+	require.Equal(t, 200, em.events.Len())
+	require.Equal(t, ids[0], em.events.items[0].id)
+
+	for _, id := range ids[0:100] {
+		em.removeEvent(id)
+	}
+	em.removeEvent("unknown")
+	require.Equal(t, 100, em.events.Len())
+	require.Len(t, em.events.index, 100)
+	for id, i := range em.events.index {
+		require.Equal(t, id, em.events.items[i].id)
+	}
+
+	last := nostr.Timestamp(0)
+	for em.events.Len() > 0 {
+		item := heap.Pop(&em.events).(expiringEvent)
+		require.GreaterOrEqual(t, item.expiresAt, last)
+		last = item.expiresAt
+	}
+	require.Len(t, em.events.index, 0)
+}
+
+func TestExpirationScheduler(t *testing.T) {
+	relay := NewRelay()
+	store := slicestore.SliceStore{}
+	store.Init()
+
+	// keep track of what was deleted
+	var mu sync.Mutex
+	deleted := make([]string, 0, 2)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, func(ctx context.Context, event *nostr.Event) error {
+		mu.Lock()
+		deleted = append(deleted, event.Content)
+		mu.Unlock()
+		return store.DeleteEvent(ctx, event)
+	})
+	deletedSoFar := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(deleted)
+	}
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	save := func(content string, expiration nostr.Timestamp) {
+		evt := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: content, Tags: nostr.Tags{
+			{"expiration", strconv.FormatInt(int64(expiration), 10)},
+		}}
+		evt.Sign(sk)
+		store.SaveEvent(ctx, &evt)
+	}
+
+	// these were stored before the relay started
+	save("expired", nostr.Now()-10)
+	save("expiring", nostr.Now()+1)
+	save("later", nostr.Now()+3600)
+
+	// the initial scan happens as soon as the relay is used
+	relay.expirationManager.begin()
+	require.Eventually(t, func() bool {
+		return slices.Equal(deletedSoFar(), []string{"expired"})
+	}, time.Second, 10*time.Millisecond)
+
+	// and then it wakes up exactly when the next event expires, not after the check interval
+	require.Eventually(t, func() bool {
+		return slices.Equal(deletedSoFar(), []string{"expired", "expiring"})
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestExpiredEventsAreHidden(t *testing.T) {
+	relay := NewRelay()
+	store := slicestore.SliceStore{}
+	store.Init()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+
+	sk := nostr.GeneratePrivateKey()
+	create := func(kind int, content string, expiration nostr.Timestamp) nostr.Event {
+		evt := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Content: content, Tags: nostr.Tags{
+			{"expiration", strconv.FormatInt(int64(expiration), 10)},
+		}}
+		evt.Sign(sk)
+		return evt
+	}
+
+	// this one expired but wasn't deleted yet
+	expired := create(1, "expired", nostr.Now()-10)
+	store.SaveEvent(context.Background(), &expired)
+	valid := create(1, "valid", nostr.Now()+3600)
+	store.SaveEvent(context.Background(), &valid)
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	read := func() nostr.Envelope {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return nostr.ParseMessage(string(msg))
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","stored",{"kinds":[1]}]`))
+	require.Equal(t, "valid", read().(*nostr.EventEnvelope).Event.Content)
+	require.IsType(t, new(nostr.EOSEEnvelope), read())
+
+	// expired events are rejected, ephemeral or not
+	for _, kind := range []int{1, 20001} {
+		evt := create(kind, "too late", nostr.Now()-1)
+		msg, _ := json.Marshal(nostr.EventEnvelope{Event: evt})
+		conn.WriteMessage(websocket.TextMessage, msg)
+		ok := read().(*nostr.OKEnvelope)
+		require.False(t, ok.OK)
+		require.Equal(t, "invalid: event is expired", ok.Reason)
+	}
+
+	// and they are never broadcasted
+	require.Equal(t, 0, relay.notifyListeners(&expired))
+	require.Equal(t, 1, relay.notifyListeners(&valid))
+	require.Equal(t, "valid", read().(*nostr.EventEnvelope).Event.Content)
+}
+
+func TestExpirationScanPages(t *testing.T) {
+	store := slicestore.SliceStore{}
+	store.Init()
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	base := nostr.Now() - 100
+	for i := range 250 {
+		evt := nostr.Event{CreatedAt: base + nostr.Timestamp(i%5), Kind: 1, Content: strconv.Itoa(i)}
+		if i%10 == 0 {
+			evt.Tags = nostr.Tags{{"expiration", strconv.FormatInt(int64(base+1000), 10)}}
+		}
+		evt.Sign(sk)
+		store.SaveEvent(ctx, &evt)
+	}
+
+	// a store that never returns more than 100 events at once
+	query := func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Limit == 0 || filter.Limit > 100 {
+			filter.Limit = 100
+		}
+		return store.QueryEvents(ctx, filter)
+	}
+
+	ids := make(map[string]struct{})
+	scanAll(ctx, query, nostr.Filter{}, func(evt *nostr.Event) { ids[evt.ID] = struct{}{} })
+	require.Len(t, ids, 250)
+
+	relay := NewRelay()
+	relay.QueryEvents = append(relay.QueryEvents, query)
+	relay.expirationManager.initialScan(ctx)
+	require.Equal(t, 25, relay.expirationManager.events.Len())
+}
+
+func TestExpirationScanLimit(t *testing.T) {
+	store := &lockedStore{}
+	store.Init()
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	base := nostr.Now() - 100
+	for i := range 300 {
+		evt := nostr.Event{CreatedAt: base + nostr.Timestamp(i), Kind: 1, Content: strconv.Itoa(i)}
+		if i < 100 || i%10 == 0 {
+			evt.Tags = nostr.Tags{{"expiration", strconv.FormatInt(int64(base+1000), 10)}}
+		}
+		evt.Sign(sk)
+		store.SaveEvent(ctx, &evt)
+	}
+
+	relay := NewRelay()
+	relay.Log.SetOutput(io.Discard)
+	relay.QueryEvents = append(relay.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		filter.Limit = 50
+		return store.QueryEvents(ctx, filter)
+	})
+	relay.expirationManager.scanLimit = 150
+	relay.expirationManager.scanPause = 10 * time.Millisecond
+
+	// only the newest events were looked at (up to the end of the page where the limit was reached)
+	relay.expirationManager.initialScan(ctx)
+	require.GreaterOrEqual(t, relay.expirationManager.events.Len(), 15)
+	require.Less(t, relay.expirationManager.events.Len(), 30)
+}
@@ -53,13 +53,19 @@ func (rl *Relay) Start(host string, port int, started ...chan bool) error {
 // Shutdown sends a websocket close control message to all connected clients.
 func (rl *Relay) Shutdown(ctx context.Context) {
 	rl.httpServer.Shutdown(ctx)
-	rl.clientsMutex.Lock()
-	defer rl.clientsMutex.Unlock()
-	for ws := range rl.clients {
-		ws.conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second))
-		ws.cancel()
-		ws.conn.Close()
+	for _, shard := range rl.shards {
+		shard.clientsMutex.Lock()
+		for ws := range shard.clients {
+			ws.conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second))
+			ws.cancel()
+			ws.conn.Close()
+		}
+		clear(shard.clients)
+		shard.clientsMutex.Unlock()
+
+		shard.listenersMutex.Lock()
+		shard.listeners = shard.listeners[:0]
+		shard.listenerIndex = newListenerIndex()
+		shard.listenersMutex.Unlock()
 	}
-	clear(rl.clients)
-	rl.listeners = rl.listeners[:0]
 }
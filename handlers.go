@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -74,15 +75,20 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 
 	ws := &WebSocket{
 		conn:               conn,
+		queue:              newOutboundQueue(rl.MaxOutboundQueue),
+		relay:              rl,
 		Request:            r,
 		Challenge:          hex.EncodeToString(challenge),
 		negentropySessions: xsync.NewMapOf[string, *NegentropySession](),
 	}
+	if rl.MaxConcurrentMessagesPerConnection > 0 {
+		ws.inflight = make(chan struct{}, rl.MaxConcurrentMessagesPerConnection)
+	}
 	ws.Context, ws.cancel = context.WithCancel(context.Background())
+	go ws.writeLoop(rl.WriteWait)
 
-	rl.clientsMutex.Lock()
-	rl.clients[ws] = make([]listenerSpec, 0, 2)
-	rl.clientsMutex.Unlock()
+	rl.addClient(ws)
+	rl.begin()
 
 	ctx, cancel := context.WithCancel(
 		context.WithValue(
@@ -91,7 +97,8 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		),
 	)
 
-	kill := func() {
+	// both goroutines below will call this when they exit, but it should only run once
+	kill := sync.OnceFunc(func() {
 		for _, ondisconnect := range rl.OnDisconnect {
 			ondisconnect(ctx)
 		}
@@ -102,7 +109,7 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		ws.conn.Close()
 
 		rl.removeClientAndListeners(ws)
-	}
+	})
 
 	go func() {
 		defer kill()
@@ -148,8 +155,8 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 			// parse messages sequentially otherwise sonic breaks
 			envelope, err := smp.ParseMessage(message)
 
-			// then delegate to the goroutine
-			go func(message string) {
+			// then delegate to a goroutine (or not, depending on the relay settings)
+			rl.dispatchMessage(ws, func() {
 				if err != nil {
 					if err == nostr.UnknownLabel && rl.Negentropy {
 						envelope = nip77.ParseNegMessage(message)
@@ -215,8 +222,11 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					var skipBroadcast bool
 
 					if env.Event.Kind == 5 {
-						// this always returns "blocked: " whenever it returns an error
+						// this always returns a prefixed reason whenever it returns an error
 						writeErr = srl.handleDeleteRequest(ctx, &env.Event)
+					} else if env.Event.Kind == 62 {
+						// same
+						writeErr = srl.handleVanishRequest(ctx, &env.Event)
 					}
 
 					if writeErr == nil {
@@ -229,6 +239,11 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 						}
 					}
 
+					// other relays may have to get this too
+					if writeErr == nil && rl.replicate != nil && !nostr.IsEphemeralKind(env.Event.Kind) {
+						rl.replicate(ctx, &env.Event, srl)
+					}
+
 					var reason string
 					if writeErr == nil {
 						ok = true
@@ -237,10 +252,12 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 						}
 						if !skipBroadcast {
 							n := srl.notifyListeners(&env.Event)
+							srl.publishToBroker(&env.Event)
 
 							// the number of notified listeners matters in ephemeral events
+							// (but we can't know about the listeners in other instances)
 							if nostr.IsEphemeralKind(env.Event.Kind) {
-								if n == 0 && len(rl.OnEphemeralEvent) == 0 {
+								if n == 0 && len(rl.OnEphemeralEvent) == 0 && srl.Broker == nil {
 									ok = false
 									reason = "mute: no one was listening for this"
 								} else {
@@ -287,8 +304,28 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					ws.WriteJSON(resp)
 
 				case *nostr.ReqEnvelope:
+					if rl.MaxFiltersPerReq > 0 && len(env.Filters) > rl.MaxFiltersPerReq {
+						ws.WriteJSON(nostr.ClosedEnvelope{
+							SubscriptionID: env.SubscriptionID,
+							Reason:         "error: too many filters, the maximum is " + strconv.Itoa(rl.MaxFiltersPerReq),
+						})
+						return
+					}
+
+					// a REQ with an id that is already in use replaces the previous subscription, so we stop that
+					// right away (it will be removed again atomically below in case another REQ comes in the meantime)
+					rl.removeListenerIdWithCause(ws, env.SubscriptionID, ErrSubscriptionReplaced)
+
+					// then check if the client isn't over the subscriptions limit before doing any work
+					// (this is checked again when the listeners are actually added)
+					if err := rl.checkSubscriptionsLimit(ws, env.SubscriptionID); err != nil {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: err.Error()})
+						return
+					}
+
 					eose := sync.WaitGroup{}
 					eose.Add(len(env.Filters))
+					timedOut := atomic.Bool{}
 
 					// a context just for the "stored events" request handler
 					reqCtx, cancelReqCtx := context.WithCancelCause(ctx)
@@ -297,12 +334,18 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					reqCtx = context.WithValue(reqCtx, subscriptionIdKey, env.SubscriptionID)
 
 					// handle each filter separately -- dispatching events as they're loaded from databases
+					generation := rl.routesGeneration.Load()
+					listeners := make([]routedFilter, 0, len(env.Filters))
 					for _, filter := range env.Filters {
-						srl := rl
-						if rl.getSubRelayFromFilter != nil {
-							srl = rl.getSubRelayFromFilter(filter)
+						routed := rl.routeRequest(filter)
+
+						var err error
+						if len(routed) > 1 {
+							// this filter goes to many places, their results are merged
+							err = rl.handleFanOutRequest(reqCtx, env.SubscriptionID, &eose, &timedOut, ws, filter, routed)
+						} else {
+							err = routed[0].subrelay.handleRequest(reqCtx, env.SubscriptionID, &eose, &timedOut, ws, routed[0].filter)
 						}
-						err := srl.handleRequest(reqCtx, env.SubscriptionID, &eose, ws, filter)
 						if err != nil {
 							// fail everything if any filter is rejected
 							reason := err.Error()
@@ -313,14 +356,40 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 							cancelReqCtx(errors.New("filter rejected"))
 							return
 						} else {
-							rl.addListener(ws, env.SubscriptionID, srl, filter, cancelReqCtx)
+							listeners = append(listeners, routed...)
+						}
+					}
+
+					// routes can't change while the listeners are put in place, and if they changed since
+					// we routed the filters above the listeners must follow the new routes
+					rl.routing.RLock()
+					if rl.routesGeneration.Load() != generation {
+						listeners = listeners[:0]
+						for _, filter := range env.Filters {
+							listeners = append(listeners, rl.routeRequest(filter)...)
 						}
 					}
+					err := rl.replaceListeners(ws, env.SubscriptionID, listeners, cancelReqCtx)
+					rl.routing.RUnlock()
+					if err != nil {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: err.Error()})
+						cancelReqCtx(err)
+						return
+					}
 
 					go func() {
 						// when all events have been loaded from databases and dispatched we can fire the EOSE message
 						eose.Wait()
-						ws.WriteJSON(nostr.EOSEEnvelope(env.SubscriptionID))
+
+						// unless this subscription was closed or replaced in the meantime
+						if reqCtx.Err() == nil {
+							ws.WriteJSON(nostr.EOSEEnvelope(env.SubscriptionID))
+
+							// if some store took too long we have sent only partial results, so maybe we close it
+							if timedOut.Load() && rl.CloseOnQueryTimeout {
+								rl.CloseSubscription(ws, env.SubscriptionID, "error: query timed out")
+							}
+						}
 					}()
 				case *nostr.CloseEnvelope:
 					id := string(*env)
@@ -409,7 +478,7 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 				case *nip77.CloseEnvelope:
 					ws.negentropySessions.Delete(env.SubscriptionID)
 				}
-			}(message)
+			})
 		}
 	}()
 
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/mailru/easyjson"
+	"github.com/mailru/easyjson/jwriter"
 	"github.com/nbd-wtf/go-nostr"
 )
 
@@ -13,6 +15,26 @@ func isOlder(previous, next *nostr.Event) bool {
 		(previous.CreatedAt == next.CreatedAt && previous.ID > next.ID)
 }
 
+// encodeEvent is meant to be called once per event, then the result can be used with eventFrame()
+// as many times as necessary
+func encodeEvent(event *nostr.Event) []byte {
+	b, _ := easyjson.Marshal(event)
+	return b
+}
+
+// eventFrame builds an EVENT envelope from an already encoded event, so we don't have to encode
+// it again for each subscription it's sent to
+func eventFrame(subscriptionID string, encodedEvent []byte) []byte {
+	w := jwriter.Writer{NoEscapeHTML: true}
+	w.RawString(`["EVENT",`)
+	w.String(subscriptionID)
+	w.RawByte(',')
+	w.Raw(encodedEvent, nil)
+	w.RawByte(']')
+	b, _ := w.BuildBytes()
+	return b
+}
+
 var privateMasks = func() []net.IPNet {
 	privateCIDRs := []string{
 		"127.0.0.0/8",
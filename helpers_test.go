@@ -0,0 +1,27 @@
+package khatru
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFrame(t *testing.T) {
+	evt := nostr.Event{
+		ID:        "0000000000000000000000000000000000000000000000000000000000000001",
+		PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Tags:      nostr.Tags{{"t", "<b>"}},
+		Content:   "hello \"world\"\n",
+	}
+	encoded := encodeEvent(&evt)
+
+	for _, id := range []string{"sub", "with \"quotes\"", "back\\slash", "<&>"} {
+		env := nostr.ParseMessage(string(eventFrame(id, encoded)))
+		require.IsType(t, &nostr.EventEnvelope{}, env)
+		require.Equal(t, id, *env.(*nostr.EventEnvelope).SubscriptionID)
+		require.Equal(t, evt, env.(*nostr.EventEnvelope).Event)
+	}
+}
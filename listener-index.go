@@ -0,0 +1,161 @@
+package khatru
+
+import (
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// listenerIndex is an inverted index over the positions of a relay's listeners slice, so we only have to
+// call filter.Matches() on listeners that have some chance of matching a given event.
+//
+// each listener is indexed under the values of a single field of its filter (the most selective one we can
+// find), or in the "broad" bucket when its filter has none of the fields we know how to index.
+type listenerIndex struct {
+	ids     indexBucket[string]
+	authors indexBucket[string]
+	tags    indexBucket[tagKey]
+	kinds   indexBucket[int]
+	broad   map[int]struct{}
+}
+
+type tagKey struct {
+	name  string
+	value string
+}
+
+type indexBucket[K comparable] map[K]map[int]struct{}
+
+func (b indexBucket[K]) add(key K, idx int) {
+	set, ok := b[key]
+	if !ok {
+		set = make(map[int]struct{}, 1)
+		b[key] = set
+	}
+	set[idx] = struct{}{}
+}
+
+func (b indexBucket[K]) remove(key K, idx int) {
+	if set, ok := b[key]; ok {
+		delete(set, idx)
+		if len(set) == 0 {
+			delete(b, key)
+		}
+	}
+}
+
+func newListenerIndex() *listenerIndex {
+	return &listenerIndex{
+		ids:     make(indexBucket[string]),
+		authors: make(indexBucket[string]),
+		tags:    make(indexBucket[tagKey]),
+		kinds:   make(indexBucket[int]),
+		broad:   make(map[int]struct{}),
+	}
+}
+
+// indexedTagName returns the single-letter tag from the filter we'll use for indexing, if any.
+// we pick the one with the fewest values, and the name is used as a tie-breaker so this is deterministic.
+func indexedTagName(filter nostr.Filter) string {
+	best := ""
+	for name, values := range filter.Tags {
+		if len(name) != 1 || values == nil {
+			continue
+		}
+		if best == "" ||
+			len(values) < len(filter.Tags[best]) ||
+			(len(values) == len(filter.Tags[best]) && name < best) {
+			best = name
+		}
+	}
+	return best
+}
+
+// add and remove must always be called with the same filter for the same idx, otherwise
+// the index will go out of sync with the listeners slice
+func (li *listenerIndex) add(filter nostr.Filter, idx int) {
+	switch {
+	case filter.IDs != nil:
+		for _, id := range filter.IDs {
+			li.ids.add(id, idx)
+		}
+	case filter.Authors != nil:
+		for _, author := range filter.Authors {
+			li.authors.add(author, idx)
+		}
+	case indexedTagName(filter) != "":
+		name := indexedTagName(filter)
+		for _, value := range filter.Tags[name] {
+			li.tags.add(tagKey{name, value}, idx)
+		}
+	case filter.Kinds != nil:
+		for _, kind := range filter.Kinds {
+			li.kinds.add(kind, idx)
+		}
+	default:
+		li.broad[idx] = struct{}{}
+	}
+}
+
+func (li *listenerIndex) remove(filter nostr.Filter, idx int) {
+	switch {
+	case filter.IDs != nil:
+		for _, id := range filter.IDs {
+			li.ids.remove(id, idx)
+		}
+	case filter.Authors != nil:
+		for _, author := range filter.Authors {
+			li.authors.remove(author, idx)
+		}
+	case indexedTagName(filter) != "":
+		name := indexedTagName(filter)
+		for _, value := range filter.Tags[name] {
+			li.tags.remove(tagKey{name, value}, idx)
+		}
+	case filter.Kinds != nil:
+		for _, kind := range filter.Kinds {
+			li.kinds.remove(kind, idx)
+		}
+	default:
+		delete(li.broad, idx)
+	}
+}
+
+// move is called when a listener is swapped to a different position in the listeners slice
+func (li *listenerIndex) move(filter nostr.Filter, from int, to int) {
+	li.remove(filter, from)
+	li.add(filter, to)
+}
+
+// candidates returns the sorted positions of all the listeners that may match the given event.
+// these must still be checked with filter.Matches() by the caller.
+func (li *listenerIndex) candidates(event *nostr.Event) []int {
+	res := make([]int, 0, len(li.broad)+8)
+
+	for idx := range li.ids[event.ID] {
+		res = append(res, idx)
+	}
+	for idx := range li.authors[event.PubKey] {
+		res = append(res, idx)
+	}
+	for idx := range li.kinds[event.Kind] {
+		res = append(res, idx)
+	}
+	if len(li.tags) > 0 {
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && len(tag[0]) == 1 {
+				for idx := range li.tags[tagKey{tag[0], tag[1]}] {
+					res = append(res, idx)
+				}
+			}
+		}
+	}
+	for idx := range li.broad {
+		res = append(res, idx)
+	}
+
+	// a listener may show up more than once if it was indexed under multiple tag values,
+	// and sorting also gives us the same order we would get if we were iterating over the slice
+	slices.Sort(res)
+	return slices.Compact(res)
+}
@@ -3,12 +3,43 @@ package khatru
 import (
 	"context"
 	"errors"
+	"fmt"
 	"slices"
+	"sync"
+	"time"
 
+	"github.com/fasthttp/websocket"
 	"github.com/nbd-wtf/go-nostr"
 )
 
-var ErrSubscriptionClosedByClient = errors.New("subscription closed by client")
+var (
+	ErrSubscriptionClosedByClient = errors.New("subscription closed by client")
+	ErrSubscriptionReplaced       = errors.New("subscription replaced by a new REQ with the same id")
+)
+
+// connections are spread across this many shards, each with its own locks, so that subscribing,
+// unsubscribing and broadcasting don't all contend on the same mutex
+const registryShards = 16
+
+type registryShard struct {
+	// used on the relay that accepts the connections
+	clients      map[*WebSocket][]listenerSpec
+	clientsMutex sync.Mutex
+
+	// used on the relay that holds the listeners, which is the same as above unless we're routing.
+	// these are modified with both mutexes locked, but notifyListeners only needs listenersMutex.
+	listeners      []listener
+	listenerIndex  *listenerIndex
+	listenersMutex sync.RWMutex
+}
+
+func newRegistryShard() *registryShard {
+	return &registryShard{
+		clients:       make(map[*WebSocket][]listenerSpec, 10),
+		listeners:     make([]listener, 0, 10),
+		listenerIndex: newListenerIndex(),
+	}
+}
 
 type listenerSpec struct {
 	id       string // kept here so we can easily match against it removeListenerId
@@ -23,14 +54,83 @@ type listener struct {
 	ws     *WebSocket
 }
 
+// Subscription describes one of the filters a client is listening to.
+type Subscription struct {
+	Connection *WebSocket
+	ID         string
+	Filter     nostr.Filter
+	SubRelay   *Relay // the relay that is serving this filter, when routing, otherwise the relay itself
+	CreatedAt  time.Time
+}
+
+// GetListeningFilters returns the filters of all the listeners currently served by this relay.
 func (rl *Relay) GetListeningFilters() []nostr.Filter {
-	respfilters := make([]nostr.Filter, len(rl.listeners))
-	for i, l := range rl.listeners {
-		respfilters[i] = l.filter
+	respfilters := make([]nostr.Filter, 0, 100)
+	for _, shard := range rl.shards {
+		shard.listenersMutex.RLock()
+		for _, l := range shard.listeners {
+			respfilters = append(respfilters, l.filter)
+		}
+		shard.listenersMutex.RUnlock()
 	}
 	return respfilters
 }
 
+// Subscriptions returns a snapshot of all the subscriptions from clients connected to this relay,
+// one entry for each filter (so a REQ with multiple filters shows up multiple times).
+func (rl *Relay) Subscriptions() []Subscription {
+	subs := make([]Subscription, 0, 100)
+	for _, shard := range rl.shards {
+		shard.clientsMutex.Lock()
+		for ws, specs := range shard.clients {
+			for _, spec := range specs {
+				lshard := spec.subrelay.shards[ws.shard]
+				lshard.listenersMutex.RLock()
+				filter := lshard.listeners[spec.index].filter
+				lshard.listenersMutex.RUnlock()
+
+				subs = append(subs, Subscription{
+					Connection: ws,
+					ID:         spec.id,
+					Filter:     filter,
+					SubRelay:   spec.subrelay,
+					CreatedAt:  ws.subscriptions[spec.id],
+				})
+			}
+		}
+		shard.clientsMutex.Unlock()
+	}
+	return subs
+}
+
+func (rl *Relay) addClient(ws *WebSocket) {
+	ws.shard = int(rl.nextShard.Add(1) % registryShards)
+
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	shard.clients[ws] = make([]listenerSpec, 0, 2)
+	shard.clientsMutex.Unlock()
+}
+
+// routedFilter is a filter along with the relay that will serve it
+type routedFilter struct {
+	subrelay *Relay
+	filter   nostr.Filter
+}
+
+// routeRequest tells which relays serve a filter from a REQ, which is just this one unless it is a router
+func (rl *Relay) routeRequest(filter nostr.Filter) []routedFilter {
+	if rl.getSubRelaysFromFilter != nil {
+		if routed := rl.getSubRelaysFromFilter(filter); len(routed) > 0 {
+			return routed
+		}
+	}
+	if rl.getSubRelayFromFilter != nil {
+		return []routedFilter{{rl.getSubRelayFromFilter(filter), filter}}
+	}
+	return []routedFilter{{rl, filter}}
+}
+
 // addListener may be called multiple times for each id and ws -- in which case each filter will
 // be added as an independent listener
 func (rl *Relay) addListener(
@@ -40,112 +140,234 @@ func (rl *Relay) addListener(
 	filter nostr.Filter,
 	cancel context.CancelCauseFunc,
 ) {
-	rl.clientsMutex.Lock()
-	defer rl.clientsMutex.Unlock()
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	defer shard.clientsMutex.Unlock()
+
+	rl.addListenerLocked(shard, ws, id, subrelay, filter, cancel)
+}
+
+// replaceListeners removes all listeners for the given subscription id and adds the new ones in a
+// single step, as NIP-01 says a REQ with an id that is already in use must replace the previous one
+func (rl *Relay) replaceListeners(
+	ws *WebSocket,
+	id string,
+	listeners []routedFilter,
+	cancel context.CancelCauseFunc,
+) error {
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	defer shard.clientsMutex.Unlock()
+
+	rl.removeListenerIdLocked(shard, ws, id, ErrSubscriptionReplaced)
+	if err := rl.checkSubscriptionsLimitLocked(ws, id); err != nil {
+		return err
+	}
+	for _, rf := range listeners {
+		rl.addListenerLocked(shard, ws, id, rf.subrelay, rf.filter, cancel)
+	}
+	return nil
+}
+
+func (rl *Relay) checkSubscriptionsLimit(ws *WebSocket, id string) error {
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	defer shard.clientsMutex.Unlock()
+
+	return rl.checkSubscriptionsLimitLocked(ws, id)
+}
+
+func (rl *Relay) checkSubscriptionsLimitLocked(ws *WebSocket, id string) error {
+	if rl.MaxSubscriptionsPerConnection <= 0 {
+		return nil
+	}
+	if _, exists := ws.subscriptions[id]; exists {
+		return nil
+	}
+	if len(ws.subscriptions) >= rl.MaxSubscriptionsPerConnection {
+		return fmt.Errorf("rate-limited: too many open subscriptions, the maximum is %d", rl.MaxSubscriptionsPerConnection)
+	}
+	return nil
+}
+
+func (rl *Relay) addListenerLocked(
+	shard *registryShard,
+	ws *WebSocket,
+	id string,
+	subrelay *Relay,
+	filter nostr.Filter,
+	cancel context.CancelCauseFunc,
+) {
+	if specs, ok := shard.clients[ws]; ok /* this will always be true unless client has disconnected very rapidly */ {
+		lshard := subrelay.shards[ws.shard]
+		lshard.listenersMutex.Lock()
+		defer lshard.listenersMutex.Unlock()
 
-	if specs, ok := rl.clients[ws]; ok /* this will always be true unless client has disconnected very rapidly */ {
-		idx := len(subrelay.listeners)
-		rl.clients[ws] = append(specs, listenerSpec{
+		idx := len(lshard.listeners)
+		shard.clients[ws] = append(specs, listenerSpec{
 			id:       id,
 			cancel:   cancel,
 			subrelay: subrelay,
 			index:    idx,
 		})
-		subrelay.listeners = append(subrelay.listeners, listener{
+		lshard.listeners = append(lshard.listeners, listener{
 			ws:     ws,
 			id:     id,
 			filter: filter,
 		})
+		lshard.listenerIndex.add(filter, idx)
+
+		if ws.subscriptions == nil {
+			ws.subscriptions = make(map[string]time.Time, 2)
+		}
+		if _, exists := ws.subscriptions[id]; !exists {
+			ws.subscriptions[id] = time.Now()
+		}
 	}
 }
 
 // remove a specific subscription id from listeners for a given ws client
 // and cancel its specific context
 func (rl *Relay) removeListenerId(ws *WebSocket, id string) {
-	rl.clientsMutex.Lock()
-	defer rl.clientsMutex.Unlock()
+	rl.removeListenerIdWithCause(ws, id, ErrSubscriptionClosedByClient)
+}
+
+func (rl *Relay) removeListenerIdWithCause(ws *WebSocket, id string, cause error) {
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	defer shard.clientsMutex.Unlock()
 
-	if specs, ok := rl.clients[ws]; ok {
+	rl.removeListenerIdLocked(shard, ws, id, cause)
+}
+
+// a nil cause means the subscription is not being closed, just changed, so its context is kept
+func (rl *Relay) removeListenerIdLocked(shard *registryShard, ws *WebSocket, id string, cause error) {
+	if specs, ok := shard.clients[ws]; ok {
 		// swap delete specs that match this id
 		for s := len(specs) - 1; s >= 0; s-- {
 			spec := specs[s]
 			if spec.id == id {
-				spec.cancel(ErrSubscriptionClosedByClient)
+				if cause != nil {
+					spec.cancel(cause)
+				}
 				specs[s] = specs[len(specs)-1]
 				specs = specs[0 : len(specs)-1]
-				rl.clients[ws] = specs
+				shard.clients[ws] = specs
 
 				// swap delete listeners one at a time, as they may be each in a different subrelay
 				srl := spec.subrelay // == rl in normal cases, but different when this came from a route
+				lshard := srl.shards[ws.shard]
+				lshard.listenersMutex.Lock()
+				lshard.listenerIndex.remove(lshard.listeners[spec.index].filter, spec.index)
 
-				if spec.index != len(srl.listeners)-1 {
-					movedFromIndex := len(srl.listeners) - 1
-					moved := srl.listeners[movedFromIndex] // this wasn't removed, but will be moved
-					srl.listeners[spec.index] = moved
+				if spec.index != len(lshard.listeners)-1 {
+					movedFromIndex := len(lshard.listeners) - 1
+					moved := lshard.listeners[movedFromIndex] // this wasn't removed, but will be moved
+					lshard.listeners[spec.index] = moved
+					lshard.listenerIndex.move(moved.filter, movedFromIndex, spec.index)
 
 					// now we must update the the listener we just moved
-					// so its .index reflects its new position on srl.listeners
-					movedSpecs := rl.clients[moved.ws]
+					// so its .index reflects its new position on lshard.listeners
+					// (it's in the same shard as us so it's also guarded by our clientsMutex)
+					movedSpecs := shard.clients[moved.ws]
 					idx := slices.IndexFunc(movedSpecs, func(ls listenerSpec) bool {
 						return ls.index == movedFromIndex && ls.subrelay == srl
 					})
 					movedSpecs[idx].index = spec.index
-					rl.clients[moved.ws] = movedSpecs
+					shard.clients[moved.ws] = movedSpecs
 				}
-				srl.listeners = srl.listeners[0 : len(srl.listeners)-1] // finally reduce the slice length
+				lshard.listeners = lshard.listeners[0 : len(lshard.listeners)-1] // finally reduce the slice length
+				lshard.listenersMutex.Unlock()
 			}
 		}
+		delete(ws.subscriptions, id)
 	}
 }
 
 func (rl *Relay) removeClientAndListeners(ws *WebSocket) {
-	rl.clientsMutex.Lock()
-	defer rl.clientsMutex.Unlock()
-	if specs, ok := rl.clients[ws]; ok {
+	shard := rl.shards[ws.shard]
+	shard.clientsMutex.Lock()
+	defer shard.clientsMutex.Unlock()
+
+	if specs, ok := shard.clients[ws]; ok {
 		// swap delete listeners and delete client (all specs will be deleted)
 		for s, spec := range specs {
 			// no need to cancel contexts since they inherit from the main connection context
 			// just delete the listeners (swap-delete)
 			srl := spec.subrelay
+			lshard := srl.shards[ws.shard]
+			lshard.listenersMutex.Lock()
+			lshard.listenerIndex.remove(lshard.listeners[spec.index].filter, spec.index)
 
-			if spec.index != len(srl.listeners)-1 {
-				movedFromIndex := len(srl.listeners) - 1
-				moved := srl.listeners[movedFromIndex] // this wasn't removed, but will be moved
-				srl.listeners[spec.index] = moved
+			if spec.index != len(lshard.listeners)-1 {
+				movedFromIndex := len(lshard.listeners) - 1
+				moved := lshard.listeners[movedFromIndex] // this wasn't removed, but will be moved
+				lshard.listeners[spec.index] = moved
+				lshard.listenerIndex.move(moved.filter, movedFromIndex, spec.index)
 
 				// temporarily update the spec of the listener being removed to have index == -1
 				// (since it was removed) so it doesn't match in the search below
-				rl.clients[ws][s].index = -1
+				shard.clients[ws][s].index = -1
 
 				// now we must update the the listener we just moved
-				// so its .index reflects its new position on srl.listeners
-				movedSpecs := rl.clients[moved.ws]
+				// so its .index reflects its new position on lshard.listeners
+				movedSpecs := shard.clients[moved.ws]
 				idx := slices.IndexFunc(movedSpecs, func(ls listenerSpec) bool {
 					return ls.index == movedFromIndex && ls.subrelay == srl
 				})
 				movedSpecs[idx].index = spec.index
-				rl.clients[moved.ws] = movedSpecs
+				shard.clients[moved.ws] = movedSpecs
 			}
-			srl.listeners = srl.listeners[0 : len(srl.listeners)-1] // finally reduce the slice length
+			lshard.listeners = lshard.listeners[0 : len(lshard.listeners)-1] // finally reduce the slice length
+			lshard.listenersMutex.Unlock()
 		}
 	}
-	delete(rl.clients, ws)
+	delete(shard.clients, ws)
 }
 
-// returns how many listeners were notified
-func (rl *Relay) notifyListeners(event *nostr.Event) int {
-	count := 0
-listenersloop:
-	for _, listener := range rl.listeners {
-		if listener.filter.Matches(event) {
-			for _, pb := range rl.PreventBroadcast {
-				if pb(listener.ws, event) {
-					continue listenersloop
+// matchingListeners uses the index to find the listeners that match the given event and are not
+// prevented from receiving it
+func (rl *Relay) matchingListeners(event *nostr.Event) []listener {
+	matching := make([]listener, 0, 4)
+	for _, shard := range rl.shards {
+		shard.listenersMutex.RLock()
+	listenersloop:
+		for _, idx := range shard.listenerIndex.candidates(event) {
+			listener := shard.listeners[idx]
+			if listener.filter.Matches(event) {
+				for _, pb := range rl.PreventBroadcast {
+					if pb(listener.ws, event) {
+						continue listenersloop
+					}
 				}
+				matching = append(matching, listener)
 			}
-			listener.ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &listener.id, Event: *event})
-			count++
 		}
+		shard.listenersMutex.RUnlock()
+	}
+	return matching
+}
+
+// returns how many listeners were notified
+func (rl *Relay) notifyListeners(event *nostr.Event) int {
+	if isExpired(event) || rl.isQuarantined(event) {
+		return 0
+	}
+
+	// we write outside of the locks so a slow client can't hold the listeners hostage
+	matching := rl.matchingListeners(event)
+	if len(matching) == 0 {
+		return 0
+	}
+
+	// the event is encoded only once, only the envelope differs for each subscription
+	encoded := encodeEvent(event)
+	for _, listener := range matching {
+		listener.ws.broadcast(outboundMessage{
+			typ:            websocket.TextMessage,
+			data:           eventFrame(listener.id, encoded),
+			subscriptionID: listener.id,
+		})
 	}
-	return count
+	return len(matching)
 }
@@ -0,0 +1,68 @@
+package khatru
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func BenchmarkNotifyListenersMatching(b *testing.B) {
+	for _, total := range []int{1_000, 10_000, 50_000} {
+		rl := NewRelay()
+		cancel := func(cause error) {}
+
+		ws := &WebSocket{}
+		rl.shards[0].clients[ws] = nil
+
+		// a realistic mix: mostly subscriptions to specific authors or p-tags, some by kind, a few very broad
+		for i := 0; i < total; i++ {
+			var f nostr.Filter
+			switch i % 10 {
+			case 0, 1, 2, 3:
+				f = nostr.Filter{Authors: []string{fmt.Sprintf("author%d", i)}, Kinds: []int{1, 6, 7}}
+			case 4, 5, 6:
+				f = nostr.Filter{Tags: nostr.TagMap{"p": []string{fmt.Sprintf("author%d", i)}}}
+			case 7, 8:
+				f = nostr.Filter{Kinds: []int{10000 + i%500}}
+			case 9:
+				if i%1000 == 9 {
+					f = nostr.Filter{}
+				} else {
+					f = nostr.Filter{IDs: []string{fmt.Sprintf("id%d", i)}}
+				}
+			}
+			rl.addListener(ws, idFromSeqLower(i), rl, f, cancel)
+		}
+
+		events := make([]*nostr.Event, 256)
+		for i := range events {
+			events[i] = &nostr.Event{
+				ID:     fmt.Sprintf("id%d", rand.Intn(total)),
+				PubKey: fmt.Sprintf("author%d", rand.Intn(total)),
+				Kind:   1,
+				Tags:   nostr.Tags{{"p", fmt.Sprintf("author%d", rand.Intn(total))}, {"e", "something"}},
+			}
+		}
+
+		b.Run(fmt.Sprintf("indexed/%d", total), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rl.matchingListeners(events[i%len(events)])
+			}
+		})
+
+		// this is what notifyListeners used to do before we had an index
+		b.Run(fmt.Sprintf("linear/%d", total), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				event := events[i%len(events)]
+				matching := make([]listener, 0, 4)
+				for _, listener := range rl.shards[0].listeners {
+					if listener.filter.Matches(event) {
+						matching = append(matching, listener)
+					}
+				}
+			}
+		})
+	}
+}
@@ -27,7 +27,7 @@ func FuzzRandomListenerClientRemoving(f *testing.F) {
 		for i := 0; i < totalWebsockets; i++ {
 			ws := &WebSocket{}
 			websockets = append(websockets, ws)
-			rl.clients[ws] = nil
+			rl.shards[0].clients[ws] = nil
 		}
 
 		s := 0
@@ -45,15 +45,15 @@ func FuzzRandomListenerClientRemoving(f *testing.F) {
 			}
 		}
 
-		require.Len(t, rl.clients, totalWebsockets)
-		require.Len(t, rl.listeners, l)
+		require.Len(t, rl.shards[0].clients, totalWebsockets)
+		require.Len(t, rl.shards[0].listeners, l)
 
-		for ws := range rl.clients {
+		for ws := range rl.shards[0].clients {
 			rl.removeClientAndListeners(ws)
 		}
 
-		require.Len(t, rl.clients, 0)
-		require.Len(t, rl.listeners, 0)
+		require.Len(t, rl.shards[0].clients, 0)
+		require.Len(t, rl.shards[0].listeners, 0)
 	})
 }
 
@@ -86,7 +86,7 @@ func FuzzRandomListenerIdRemoving(f *testing.F) {
 		for i := 0; i < totalWebsockets; i++ {
 			ws := &WebSocket{}
 			websockets = append(websockets, ws)
-			rl.clients[ws] = nil
+			rl.shards[0].clients[ws] = nil
 		}
 
 		s := 0
@@ -110,8 +110,8 @@ func FuzzRandomListenerIdRemoving(f *testing.F) {
 			}
 		}
 
-		require.Len(t, rl.clients, totalWebsockets)
-		require.Len(t, rl.listeners, len(subs)+extra)
+		require.Len(t, rl.shards[0].clients, totalWebsockets)
+		require.Len(t, rl.shards[0].listeners, len(subs)+extra)
 
 		rand.Shuffle(len(subs), func(i, j int) {
 			subs[i], subs[j] = subs[j], subs[i]
@@ -120,9 +120,9 @@ func FuzzRandomListenerIdRemoving(f *testing.F) {
 			rl.removeListenerId(wsidToRemove.ws, wsidToRemove.id)
 		}
 
-		require.Len(t, rl.listeners, 0)
-		require.Len(t, rl.clients, totalWebsockets)
-		for _, specs := range rl.clients {
+		require.Len(t, rl.shards[0].listeners, 0)
+		require.Len(t, rl.shards[0].clients, totalWebsockets)
+		for _, specs := range rl.shards[0].clients {
 			require.Len(t, specs, 0)
 		}
 	})
@@ -147,7 +147,7 @@ func FuzzRouterListenersPabloCrash(f *testing.F) {
 		for i := 0; i < int(totalConns); i++ {
 			ws := &WebSocket{}
 			conns[i] = ws
-			rl.clients[ws] = make([]listenerSpec, 0, subIterations)
+			rl.shards[0].clients[ws] = make([]listenerSpec, 0, subIterations)
 		}
 
 		f := nostr.Filter{Kinds: []int{1}}
@@ -179,10 +179,10 @@ func FuzzRouterListenersPabloCrash(f *testing.F) {
 		}
 
 		for _, wsid := range subs {
-			require.Len(t, rl.clients[wsid.ws], 0)
+			require.Len(t, rl.shards[0].clients[wsid.ws], 0)
 		}
 		for _, rlt := range relays {
-			require.Len(t, rlt.listeners, 0)
+			require.Len(t, rlt.shards[0].listeners, 0)
 		}
 	})
 }
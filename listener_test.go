@@ -1,9 +1,13 @@
 package khatru
 
 import (
+	"maps"
 	"math/rand"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/require"
@@ -33,8 +37,8 @@ func TestListenerSetupAndRemoveOnce(t *testing.T) {
 	f2 := nostr.Filter{Kinds: []int{2}}
 	f3 := nostr.Filter{Kinds: []int{3}}
 
-	rl.clients[ws1] = nil
-	rl.clients[ws2] = nil
+	rl.shards[0].clients[ws1] = nil
+	rl.shards[0].clients[ws2] = nil
 
 	var cancel func(cause error) = nil
 
@@ -53,14 +57,14 @@ func TestListenerSetupAndRemoveOnce(t *testing.T) {
 			ws2: {
 				{"2a", cancel, 2, rl},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"1a", f1, ws1},
 			{"1b", f2, ws1},
 			{"2a", f3, ws2},
 			{"1c", f3, ws1},
-		}, rl.listeners)
+		}, rl.shards[0].listeners)
 	})
 
 	t.Run("removing a client", func(t *testing.T) {
@@ -70,11 +74,11 @@ func TestListenerSetupAndRemoveOnce(t *testing.T) {
 			ws2: {
 				{"2a", cancel, 0, rl},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"2a", f3, ws2},
-		}, rl.listeners)
+		}, rl.shards[0].listeners)
 	})
 }
 
@@ -90,10 +94,10 @@ func TestListenerMoreConvolutedCase(t *testing.T) {
 	f2 := nostr.Filter{Kinds: []int{2}}
 	f3 := nostr.Filter{Kinds: []int{3}}
 
-	rl.clients[ws1] = nil
-	rl.clients[ws2] = nil
-	rl.clients[ws3] = nil
-	rl.clients[ws4] = nil
+	rl.shards[0].clients[ws1] = nil
+	rl.shards[0].clients[ws2] = nil
+	rl.shards[0].clients[ws3] = nil
+	rl.shards[0].clients[ws4] = nil
 
 	var cancel func(cause error) = nil
 
@@ -118,7 +122,7 @@ func TestListenerMoreConvolutedCase(t *testing.T) {
 			ws4: {
 				{"d", cancel, 3, rl},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
@@ -126,7 +130,7 @@ func TestListenerMoreConvolutedCase(t *testing.T) {
 			{"a", f3, ws3},
 			{"d", f3, ws4},
 			{"b", f1, ws2},
-		}, rl.listeners)
+		}, rl.shards[0].listeners)
 	})
 
 	t.Run("removing a client", func(t *testing.T) {
@@ -142,17 +146,17 @@ func TestListenerMoreConvolutedCase(t *testing.T) {
 			ws4: {
 				{"d", cancel, 1, rl},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
 			{"d", f3, ws4},
 			{"a", f3, ws3},
-		}, rl.listeners)
+		}, rl.shards[0].listeners)
 	})
 
 	t.Run("reorganize the first case differently and then remove again", func(t *testing.T) {
-		rl.clients = map[*WebSocket][]listenerSpec{
+		rl.shards[0].clients = map[*WebSocket][]listenerSpec{
 			ws1: {
 				{"c", cancel, 1, rl},
 			},
@@ -167,7 +171,7 @@ func TestListenerMoreConvolutedCase(t *testing.T) {
 				{"d", cancel, 3, rl},
 			},
 		}
-		rl.listeners = []listener{
+		rl.shards[0].listeners = []listener{
 			{"a", f3, ws3},
 			{"c", f1, ws1},
 			{"b", f2, ws2},
@@ -187,13 +191,13 @@ func TestListenerMoreConvolutedCase(t *testing.T) {
 			ws4: {
 				{"d", cancel, 2, rl},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"a", f3, ws3},
 			{"c", f1, ws1},
 			{"d", f3, ws4},
-		}, rl.listeners)
+		}, rl.shards[0].listeners)
 	})
 }
 
@@ -213,10 +217,10 @@ func TestListenerMoreStuffWithMultipleRelays(t *testing.T) {
 	rly := NewRelay()
 	rlz := NewRelay()
 
-	rl.clients[ws1] = nil
-	rl.clients[ws2] = nil
-	rl.clients[ws3] = nil
-	rl.clients[ws4] = nil
+	rl.shards[0].clients[ws1] = nil
+	rl.shards[0].clients[ws2] = nil
+	rl.shards[0].clients[ws3] = nil
+	rl.shards[0].clients[ws4] = nil
 
 	var cancel func(cause error) = nil
 
@@ -251,31 +255,31 @@ func TestListenerMoreStuffWithMultipleRelays(t *testing.T) {
 				{"e", cancel, 2, rlx},
 				{"e", cancel, 1, rly},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
 			{"d", f3, ws4},
 			{"e", f3, ws4},
 			{"a", f3, ws3},
-		}, rlx.listeners)
+		}, rlx.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"b", f2, ws2},
 			{"e", f3, ws4},
 			{"f", f3, ws3},
-		}, rly.listeners)
+		}, rly.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"a", f3, ws3},
 			{"g", f1, ws1},
 			{"g", f2, ws2},
-		}, rlz.listeners)
+		}, rlz.shards[0].listeners)
 	})
 
 	t.Run("removing a subscription id", func(t *testing.T) {
 		// removing 'd' from ws4
-		rl.clients[ws4][0].cancel = func(cause error) {} // set since removing will call it
+		rl.shards[0].clients[ws4][0].cancel = func(cause error) {} // set since removing will call it
 		rl.removeListenerId(ws4, "d")
 
 		require.Equal(t, map[*WebSocket][]listenerSpec{
@@ -296,31 +300,31 @@ func TestListenerMoreStuffWithMultipleRelays(t *testing.T) {
 				{"e", cancel, 1, rly},
 				{"e", cancel, 2, rlx},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
 			{"a", f3, ws3},
 			{"e", f3, ws4},
-		}, rlx.listeners)
+		}, rlx.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"b", f2, ws2},
 			{"e", f3, ws4},
 			{"f", f3, ws3},
-		}, rly.listeners)
+		}, rly.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"a", f3, ws3},
 			{"g", f1, ws1},
 			{"g", f2, ws2},
-		}, rlz.listeners)
+		}, rlz.shards[0].listeners)
 	})
 
 	t.Run("removing another subscription id", func(t *testing.T) {
 		// removing 'a' from ws3
-		rl.clients[ws3][0].cancel = func(cause error) {} // set since removing will call it
-		rl.clients[ws3][1].cancel = func(cause error) {} // set since removing will call it
+		rl.shards[0].clients[ws3][0].cancel = func(cause error) {} // set since removing will call it
+		rl.shards[0].clients[ws3][1].cancel = func(cause error) {} // set since removing will call it
 		rl.removeListenerId(ws3, "a")
 
 		require.Equal(t, map[*WebSocket][]listenerSpec{
@@ -339,23 +343,23 @@ func TestListenerMoreStuffWithMultipleRelays(t *testing.T) {
 				{"e", cancel, 1, rly},
 				{"e", cancel, 1, rlx},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
 			{"e", f3, ws4},
-		}, rlx.listeners)
+		}, rlx.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"b", f2, ws2},
 			{"e", f3, ws4},
 			{"f", f3, ws3},
-		}, rly.listeners)
+		}, rly.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"g", f2, ws2},
 			{"g", f1, ws1},
-		}, rlz.listeners)
+		}, rlz.shards[0].listeners)
 	})
 
 	t.Run("removing a connection", func(t *testing.T) {
@@ -373,27 +377,27 @@ func TestListenerMoreStuffWithMultipleRelays(t *testing.T) {
 				{"e", cancel, 1, rly},
 				{"e", cancel, 1, rlx},
 			},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
 			{"e", f3, ws4},
-		}, rlx.listeners)
+		}, rlx.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"f", f3, ws3},
 			{"e", f3, ws4},
-		}, rly.listeners)
+		}, rly.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"g", f1, ws1},
-		}, rlz.listeners)
+		}, rlz.shards[0].listeners)
 	})
 
 	t.Run("removing another subscription id", func(t *testing.T) {
 		// removing 'e' from ws4
-		rl.clients[ws4][0].cancel = func(cause error) {} // set since removing will call it
-		rl.clients[ws4][1].cancel = func(cause error) {} // set since removing will call it
+		rl.shards[0].clients[ws4][0].cancel = func(cause error) {} // set since removing will call it
+		rl.shards[0].clients[ws4][1].cancel = func(cause error) {} // set since removing will call it
 		rl.removeListenerId(ws4, "e")
 
 		require.Equal(t, map[*WebSocket][]listenerSpec{
@@ -405,19 +409,19 @@ func TestListenerMoreStuffWithMultipleRelays(t *testing.T) {
 				{"f", cancel, 0, rly},
 			},
 			ws4: {},
-		}, rl.clients)
+		}, rl.shards[0].clients)
 
 		require.Equal(t, []listener{
 			{"c", f1, ws1},
-		}, rlx.listeners)
+		}, rlx.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"f", f3, ws3},
-		}, rly.listeners)
+		}, rly.shards[0].listeners)
 
 		require.Equal(t, []listener{
 			{"g", f1, ws1},
-		}, rlz.listeners)
+		}, rlz.shards[0].listeners)
 	})
 }
 
@@ -434,7 +438,7 @@ func TestRandomListenerClientRemoving(t *testing.T) {
 	for i := 0; i < 20; i++ {
 		ws := &WebSocket{}
 		websockets = append(websockets, ws)
-		rl.clients[ws] = nil
+		rl.shards[0].clients[ws] = nil
 	}
 
 	for j := 0; j < 20; j++ {
@@ -449,15 +453,15 @@ func TestRandomListenerClientRemoving(t *testing.T) {
 		}
 	}
 
-	require.Len(t, rl.clients, 20)
-	require.Len(t, rl.listeners, l)
+	require.Len(t, rl.shards[0].clients, 20)
+	require.Len(t, rl.shards[0].listeners, l)
 
-	for ws := range rl.clients {
+	for ws := range rl.shards[0].clients {
 		rl.removeClientAndListeners(ws)
 	}
 
-	require.Len(t, rl.clients, 0)
-	require.Len(t, rl.listeners, 0)
+	require.Len(t, rl.shards[0].clients, 0)
+	require.Len(t, rl.shards[0].listeners, 0)
 }
 
 func TestRandomListenerIdRemoving(t *testing.T) {
@@ -479,7 +483,7 @@ func TestRandomListenerIdRemoving(t *testing.T) {
 	for i := 0; i < 20; i++ {
 		ws := &WebSocket{}
 		websockets = append(websockets, ws)
-		rl.clients[ws] = nil
+		rl.shards[0].clients[ws] = nil
 	}
 
 	for j := 0; j < 20; j++ {
@@ -500,8 +504,8 @@ func TestRandomListenerIdRemoving(t *testing.T) {
 		}
 	}
 
-	require.Len(t, rl.clients, 20)
-	require.Len(t, rl.listeners, len(subs)+extra)
+	require.Len(t, rl.shards[0].clients, 20)
+	require.Len(t, rl.shards[0].listeners, len(subs)+extra)
 
 	rand.Shuffle(len(subs), func(i, j int) {
 		subs[i], subs[j] = subs[j], subs[i]
@@ -510,9 +514,9 @@ func TestRandomListenerIdRemoving(t *testing.T) {
 		rl.removeListenerId(wsidToRemove.ws, wsidToRemove.id)
 	}
 
-	require.Len(t, rl.listeners, 0)
-	require.Len(t, rl.clients, 20)
-	for _, specs := range rl.clients {
+	require.Len(t, rl.shards[0].listeners, 0)
+	require.Len(t, rl.shards[0].clients, 20)
+	for _, specs := range rl.shards[0].clients {
 		require.Len(t, specs, 0)
 	}
 }
@@ -527,9 +531,9 @@ func TestRouterListenersPabloCrash(t *testing.T) {
 	ws2 := &WebSocket{}
 	ws3 := &WebSocket{}
 
-	rl.clients[ws1] = nil
-	rl.clients[ws2] = nil
-	rl.clients[ws3] = nil
+	rl.shards[0].clients[ws1] = nil
+	rl.shards[0].clients[ws2] = nil
+	rl.shards[0].clients[ws3] = nil
 
 	f := nostr.Filter{Kinds: []int{1}}
 	cancel := func(cause error) {}
@@ -543,3 +547,209 @@ func TestRouterListenersPabloCrash(t *testing.T) {
 	rl.removeClientAndListeners(ws1)
 	rl.removeClientAndListeners(ws3)
 }
+
+func TestListenerIndexMatchesLinearScan(t *testing.T) {
+	rl := NewRelay()
+
+	kinds := []int{0, 1, 3, 7, 30023}
+	pubkeys := []string{"aa", "bb", "cc", "dd"}
+	values := []string{"x", "y", "z"}
+
+	pick := func(src []string) []string {
+		res := make([]string, 0, 2)
+		for _, v := range src {
+			if rand.Intn(3) == 0 {
+				res = append(res, v)
+			}
+		}
+		return res
+	}
+
+	randomFilter := func() nostr.Filter {
+		f := nostr.Filter{}
+		if rand.Intn(6) == 0 {
+			f.IDs = pick([]string{"id1", "id2", "id3"})
+		}
+		if rand.Intn(3) == 0 {
+			f.Authors = pick(pubkeys)
+		}
+		if rand.Intn(2) == 0 {
+			f.Kinds = []int{kinds[rand.Intn(len(kinds))]}
+		}
+		if rand.Intn(3) == 0 {
+			f.Tags = nostr.TagMap{"t": pick(values)}
+			if rand.Intn(2) == 0 {
+				f.Tags["p"] = pick(pubkeys)
+			}
+			if rand.Intn(4) == 0 {
+				f.Tags["alt"] = pick(values)
+			}
+		}
+		return f
+	}
+
+	randomEvent := func() *nostr.Event {
+		evt := &nostr.Event{
+			ID:     []string{"id1", "id2", "id3", "id4"}[rand.Intn(4)],
+			PubKey: pubkeys[rand.Intn(len(pubkeys))],
+			Kind:   kinds[rand.Intn(len(kinds))],
+		}
+		for _, v := range pick(values) {
+			evt.Tags = append(evt.Tags, nostr.Tag{"t", v})
+		}
+		for _, v := range pick(pubkeys) {
+			evt.Tags = append(evt.Tags, nostr.Tag{"p", v})
+		}
+		for _, v := range pick(values) {
+			evt.Tags = append(evt.Tags, nostr.Tag{"alt", v})
+		}
+		return evt
+	}
+
+	linearScan := func(evt *nostr.Event) []listener {
+		res := make([]listener, 0)
+		for _, l := range rl.shards[0].listeners {
+			if l.filter.Matches(evt) {
+				res = append(res, l)
+			}
+		}
+		return res
+	}
+
+	cancel := func(cause error) {}
+	websockets := make([]*WebSocket, 10)
+	for i := range websockets {
+		websockets[i] = &WebSocket{}
+		rl.shards[0].clients[websockets[i]] = nil
+	}
+
+	type wsid struct {
+		ws *WebSocket
+		id string
+	}
+	subs := make([]wsid, 0, 200)
+	for i := 0; i < 200; i++ {
+		ws := websockets[rand.Intn(len(websockets))]
+		id := idFromSeqLower(i)
+		rl.addListener(ws, id, rl, randomFilter(), cancel)
+		subs = append(subs, wsid{ws, id})
+	}
+
+	check := func() {
+		for i := 0; i < 300; i++ {
+			evt := randomEvent()
+			require.Equal(t, linearScan(evt), rl.matchingListeners(evt))
+		}
+	}
+
+	check()
+
+	rand.Shuffle(len(subs), func(i, j int) { subs[i], subs[j] = subs[j], subs[i] })
+	for _, sub := range subs[0:80] {
+		rl.removeListenerId(sub.ws, sub.id)
+	}
+	check()
+
+	rl.removeClientAndListeners(websockets[0])
+	rl.removeClientAndListeners(websockets[1])
+	check()
+
+	for _, ws := range websockets[2:] {
+		rl.removeClientAndListeners(ws)
+	}
+	require.Len(t, rl.shards[0].listeners, 0)
+	require.Empty(t, rl.shards[0].listenerIndex.ids)
+	require.Empty(t, rl.shards[0].listenerIndex.authors)
+	require.Empty(t, rl.shards[0].listenerIndex.tags)
+	require.Empty(t, rl.shards[0].listenerIndex.kinds)
+	require.Empty(t, rl.shards[0].listenerIndex.broad)
+}
+
+func TestListenerRegistryConcurrentAccess(t *testing.T) {
+	rl := NewRelay()
+	cancel := func(cause error) {}
+
+	websockets := make([]*WebSocket, 40)
+	for i := range websockets {
+		websockets[i] = &WebSocket{}
+		rl.addClient(websockets[i])
+	}
+
+	evt := &nostr.Event{Kind: 1}
+	wg := sync.WaitGroup{}
+	for i, ws := range websockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := idFromSeqLower(j % 5)
+				rl.addListener(ws, id, rl, nostr.Filter{Kinds: []int{1}}, cancel)
+				rl.matchingListeners(evt)
+				if j%3 == 0 {
+					rl.removeListenerId(ws, id)
+				}
+				rl.GetListeningFilters()
+				rl.Subscriptions()
+			}
+			if i%2 == 0 {
+				rl.removeClientAndListeners(ws)
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, shard := range rl.shards {
+		require.Len(t, shard.listeners, len(slices.Concat(slices.Collect(maps.Values(shard.clients))...)))
+		total += len(shard.listeners)
+	}
+	require.Len(t, rl.matchingListeners(evt), total)
+	require.Len(t, rl.Subscriptions(), total)
+	require.Len(t, rl.GetListeningFilters(), total)
+}
+
+func TestSubscriptionsSnapshot(t *testing.T) {
+	rl := NewRelay()
+	rlx := NewRelay()
+	cancel := func(cause error) {}
+
+	ws1 := &WebSocket{}
+	ws2 := &WebSocket{}
+	rl.addClient(ws1)
+	rl.addClient(ws2)
+
+	f1 := nostr.Filter{Kinds: []int{1}}
+	f2 := nostr.Filter{Authors: []string{"aa"}}
+
+	before := time.Now()
+	rl.addListener(ws1, "a", rl, f1, cancel)
+	rl.addListener(ws1, "a", rlx, f2, cancel)
+	rl.addListener(ws2, "b", rl, f2, cancel)
+
+	subs := rl.Subscriptions()
+	require.Len(t, subs, 3)
+	slices.SortFunc(subs, func(a, b Subscription) int {
+		return strings.Compare(a.ID+a.Filter.String(), b.ID+b.Filter.String())
+	})
+
+	require.Equal(t, ws1, subs[0].Connection)
+	require.Equal(t, "a", subs[0].ID)
+	require.Equal(t, f2, subs[0].Filter)
+	require.Equal(t, rlx, subs[0].SubRelay)
+	require.Equal(t, ws1, subs[1].Connection)
+	require.Equal(t, f1, subs[1].Filter)
+	require.Equal(t, rl, subs[1].SubRelay)
+	require.Equal(t, subs[0].CreatedAt, subs[1].CreatedAt)
+	require.Equal(t, ws2, subs[2].Connection)
+	require.Equal(t, "b", subs[2].ID)
+	for _, sub := range subs {
+		require.False(t, sub.CreatedAt.Before(before))
+	}
+
+	rl.removeListenerId(ws1, "a")
+	subs = rl.Subscriptions()
+	require.Len(t, subs, 1)
+	require.Equal(t, "b", subs[0].ID)
+	require.Len(t, rl.GetListeningFilters(), 1)
+	require.Len(t, rlx.GetListeningFilters(), 0)
+}
@@ -0,0 +1,185 @@
+package management
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// FileAuditLog appends each entry as a line of JSON to a file.
+type FileAuditLog struct {
+	Path string
+}
+
+func (fa FileAuditLog) Write(ctx context.Context, entry khatru.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fa.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (fa FileAuditLog) List(ctx context.Context, limit int) ([]khatru.AuditEntry, error) {
+	data, err := os.ReadFile(fa.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the last piece is either empty or a line that is still being written
+	lines := bytes.Split(data, []byte{'\n'})
+	lines = lines[0 : len(lines)-1]
+
+	entries := make([]khatru.AuditEntry, 0, min(limit, len(lines)))
+	for i := len(lines) - 1; i >= 0 && len(entries) < limit; i-- {
+		var entry khatru.AuditEntry
+		if err := json.Unmarshal(lines[i], &entry); err != nil {
+			return nil, fmt.Errorf("invalid line %d on %s: %w", i+1, fa.Path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// EventAuditLog stores each entry as a regular event signed by the relay in an eventstore.
+//
+// Like with EventStorage, these are not encrypted, so they should be kept in a store that isn't used
+// for the relay's public events.
+type EventAuditLog struct {
+	Store     eventstore.Store
+	SecretKey string
+
+	// defaults to 8886
+	Kind int
+}
+
+func (ea EventAuditLog) kind() int {
+	if ea.Kind == 0 {
+		return 8886
+	}
+	return ea.Kind
+}
+
+func (ea EventAuditLog) Write(ctx context.Context, entry khatru.AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	evt := nostr.Event{
+		CreatedAt: entry.Timestamp,
+		Kind:      ea.kind(),
+		Tags:      nostr.Tags{{"method", entry.Method}, {"hash", entry.Hash}},
+		Content:   string(data),
+	}
+	if err := evt.Sign(ea.SecretKey); err != nil {
+		return err
+	}
+	return ea.Store.SaveEvent(ctx, &evt)
+}
+
+func (ea EventAuditLog) List(ctx context.Context, limit int) ([]khatru.AuditEntry, error) {
+	pubkey, err := nostr.GetPublicKey(ea.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := nostr.Filter{Kinds: []int{ea.kind()}, Authors: []string{pubkey}, Limit: limit}
+	events, err := ea.query(ctx, filter)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+
+	// the limit may have cut a second in which there were multiple entries, so we get all of that second,
+	// otherwise we can't know which of them are the most recent
+	oldest := events[0].CreatedAt
+	for _, evt := range events {
+		oldest = min(oldest, evt.CreatedAt)
+	}
+	since := oldest - 1
+	filter.Since = &since
+	filter.Until = &oldest
+	filter.Limit = 0
+	sameSecond, err := ea.query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(events)+len(sameSecond))
+	entries := make([]khatru.AuditEntry, 0, len(events)+len(sameSecond))
+	for _, evt := range append(events, sameSecond...) {
+		if seen[evt.ID] || evt.CreatedAt < oldest {
+			continue
+		}
+		seen[evt.ID] = true
+
+		var entry khatru.AuditEntry
+		if err := json.Unmarshal([]byte(evt.Content), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit event %s: %w", evt.ID, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	entries = chainOrder(entries)
+	return entries[0:min(limit, len(entries))], nil
+}
+
+func (ea EventAuditLog) query(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	ch, err := ea.Store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*nostr.Event, 0, filter.Limit)
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events, nil
+}
+
+// chainOrder sorts entries newest first, using the hash chain for entries created in the same second
+func chainOrder(entries []khatru.AuditEntry) []khatru.AuditEntry {
+	slices.SortStableFunc(entries, func(a, b khatru.AuditEntry) int { return int(b.Timestamp - a.Timestamp) })
+
+	byHash := make(map[string]khatru.AuditEntry, len(entries))
+	referenced := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		byHash[entry.Hash] = entry
+		referenced[entry.Previous] = true
+	}
+
+	for _, head := range entries {
+		if referenced[head.Hash] {
+			continue
+		}
+
+		ordered := make([]khatru.AuditEntry, 0, len(entries))
+		for entry, ok := head, true; ok && len(ordered) < len(entries); entry, ok = byHash[entry.Previous] {
+			ordered = append(ordered, entry)
+		}
+		if len(ordered) == len(entries) {
+			return ordered
+		}
+		break
+	}
+
+	// the chain is broken somewhere, so the timestamps will have to do
+	return entries
+}
@@ -0,0 +1,491 @@
+// Package management provides a ready-made implementation of the NIP-86 relay management API that
+// persists its state and enforces it on the relay.
+package management
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// Backend keeps lists of banned and allowed pubkeys, events, kinds and IPs, and enforces them.
+type Backend struct {
+	relay   *khatru.Relay
+	storage Storage
+
+	saving sync.Mutex // changes are saved one at a time, but without blocking the readers of the state
+	mu     sync.RWMutex
+	state  State
+
+	// events being held for moderation, kept apart from the rest of the state so the relay can check
+	// them on every event without waiting for anything
+	held *xsync.MapOf[string, string]
+}
+
+// New loads the state from storage, sets up all the ManagementAPI methods on the relay and
+// installs the hooks that enforce the state on it. Changes take effect immediately.
+func New(ctx context.Context, relay *khatru.Relay, storage Storage) (*Backend, error) {
+	state, err := storage.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load management state: %w", err)
+	}
+	state.init()
+
+	b := &Backend{
+		relay:   relay,
+		storage: storage,
+		state:   state,
+		held:    xsync.NewMapOf[string, string](),
+	}
+	for id, reason := range state.Quarantined {
+		b.held.Store(id, reason)
+	}
+	b.applyInfo()
+
+	relay.ManagementAPI.BanPubKey = b.BanPubKey
+	relay.ManagementAPI.ListBannedPubKeys = b.ListBannedPubKeys
+	relay.ManagementAPI.AllowPubKey = b.AllowPubKey
+	relay.ManagementAPI.ListAllowedPubKeys = b.ListAllowedPubKeys
+	relay.ManagementAPI.BanEvent = b.BanEvent
+	relay.ManagementAPI.AllowEvent = b.AllowEvent
+	relay.ManagementAPI.ListBannedEvents = b.ListBannedEvents
+	relay.ManagementAPI.ListAllowedEvents = b.ListAllowedEvents
+	relay.ManagementAPI.ChangeRelayName = b.ChangeRelayName
+	relay.ManagementAPI.ChangeRelayDescription = b.ChangeRelayDescription
+	relay.ManagementAPI.ChangeRelayIcon = b.ChangeRelayIcon
+	relay.ManagementAPI.AllowKind = b.AllowKind
+	relay.ManagementAPI.DisallowKind = b.DisallowKind
+	relay.ManagementAPI.ListAllowedKinds = b.ListAllowedKinds
+	relay.ManagementAPI.ListDisAllowedKinds = b.ListDisallowedKinds
+	relay.ManagementAPI.BlockIP = b.BlockIP
+	relay.ManagementAPI.UnblockIP = b.UnblockIP
+	relay.ManagementAPI.ListBlockedIPs = b.ListBlockedIPs
+	relay.ManagementAPI.GrantAdmin = b.GrantAdmin
+	relay.ManagementAPI.RevokeAdmin = b.RevokeAdmin
+	relay.ManagementAPI.AdminMethods = b.AdminMethods
+	relay.ManagementAPI.Stats = b.Stats
+	relay.Quarantine = quarantine{b}
+
+	relay.RejectConnection = append(relay.RejectConnection, b.rejectConnection)
+	relay.RejectEvent = append(relay.RejectEvent, b.rejectEvent)
+	relay.RejectFilter = append(relay.RejectFilter, b.rejectFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, b.rejectFilter)
+
+	// in case the state is stored along with the relay's events
+	if es, ok := storage.(EventStorage); ok {
+		relay.RejectFilter = append(relay.RejectFilter, es.rejectFilter)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, es.rejectFilter)
+	}
+
+	return b, nil
+}
+
+// update applies a change to a copy of the state, persists it and only then makes it current
+func (b *Backend) update(ctx context.Context, change func(state *State) error) error {
+	b.saving.Lock()
+	defer b.saving.Unlock()
+
+	b.mu.RLock()
+	next := State{
+		BannedPubKeys:   maps.Clone(b.state.BannedPubKeys),
+		AllowedPubKeys:  maps.Clone(b.state.AllowedPubKeys),
+		BannedEvents:    maps.Clone(b.state.BannedEvents),
+		AllowedEvents:   maps.Clone(b.state.AllowedEvents),
+		AllowedKinds:    slices.Clone(b.state.AllowedKinds),
+		DisallowedKinds: slices.Clone(b.state.DisallowedKinds),
+		BlockedIPs:      maps.Clone(b.state.BlockedIPs),
+		Quarantined:     make(map[string]string, b.held.Size()),
+		Admins:          maps.Clone(b.state.Admins),
+		Name:            b.state.Name,
+		Description:     b.state.Description,
+		Icon:            b.state.Icon,
+	}
+	b.mu.RUnlock()
+	b.held.Range(func(id string, reason string) bool {
+		next.Quarantined[id] = reason
+		return true
+	})
+
+	if err := change(&next); err != nil {
+		return err
+	}
+	if err := b.storage.Save(ctx, next); err != nil {
+		return fmt.Errorf("failed to save: %w", err)
+	}
+
+	b.mu.Lock()
+	b.state = next
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Backend) applyInfo() {
+	if b.relay.Info == nil {
+		return
+	}
+	if b.state.Name != "" {
+		b.relay.Info.Name = b.state.Name
+	}
+	if b.state.Description != "" {
+		b.relay.Info.Description = b.state.Description
+	}
+	if b.state.Icon != "" {
+		b.relay.Info.Icon = b.state.Icon
+	}
+}
+
+func (b *Backend) rejectConnection(r *http.Request) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, blocked := b.state.BlockedIPs[khatru.GetIPFromRequest(r)]
+	return blocked
+}
+
+func (b *Backend) rejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if _, banned := b.state.BannedEvents[event.ID]; banned {
+		return true, "blocked: this event is banned"
+	}
+	if _, banned := b.state.BannedPubKeys[event.PubKey]; banned {
+		return true, "blocked: this pubkey is banned"
+	}
+	if len(b.state.AllowedPubKeys) > 0 {
+		if _, allowed := b.state.AllowedPubKeys[event.PubKey]; !allowed {
+			return true, "blocked: this pubkey is not allowed"
+		}
+	}
+	if slices.Contains(b.state.DisallowedKinds, event.Kind) ||
+		(len(b.state.AllowedKinds) > 0 && !slices.Contains(b.state.AllowedKinds, event.Kind)) {
+		return true, fmt.Sprintf("blocked: kind %d is not allowed", event.Kind)
+	}
+	return false, ""
+}
+
+func (b *Backend) rejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	authed := khatru.GetAuthed(ctx)
+	if authed == "" {
+		return false, ""
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if _, banned := b.state.BannedPubKeys[authed]; banned {
+		return true, "blocked: you are banned"
+	}
+	return false, ""
+}
+
+func (b *Backend) BanPubKey(ctx context.Context, pubkey string, reason string) error {
+	if !nostr.IsValidPublicKey(pubkey) {
+		return fmt.Errorf("invalid pubkey '%s'", pubkey)
+	}
+	return b.update(ctx, func(state *State) error {
+		delete(state.AllowedPubKeys, pubkey)
+		state.BannedPubKeys[pubkey] = reason
+		return nil
+	})
+}
+
+func (b *Backend) ListBannedPubKeys(ctx context.Context) ([]nip86.PubKeyReason, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return pubkeyReasons(b.state.BannedPubKeys), nil
+}
+
+func (b *Backend) AllowPubKey(ctx context.Context, pubkey string, reason string) error {
+	if !nostr.IsValidPublicKey(pubkey) {
+		return fmt.Errorf("invalid pubkey '%s'", pubkey)
+	}
+	return b.update(ctx, func(state *State) error {
+		delete(state.BannedPubKeys, pubkey)
+		state.AllowedPubKeys[pubkey] = reason
+		return nil
+	})
+}
+
+func (b *Backend) ListAllowedPubKeys(ctx context.Context) ([]nip86.PubKeyReason, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return pubkeyReasons(b.state.AllowedPubKeys), nil
+}
+
+// BanEvent also deletes the event from the relay.
+func (b *Backend) BanEvent(ctx context.Context, id string, reason string) error {
+	if !nostr.IsValid32ByteHex(id) {
+		return fmt.Errorf("invalid event id '%s'", id)
+	}
+	if err := b.update(ctx, func(state *State) error {
+		delete(state.AllowedEvents, id)
+		state.BannedEvents[id] = reason
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, query := range b.relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			continue
+		}
+		targets := make([]*nostr.Event, 0, 1)
+		for evt := range ch {
+			targets = append(targets, evt)
+		}
+		for _, target := range targets {
+			for _, del := range b.relay.DeleteEvent {
+				if err := del(ctx, target); err != nil {
+					return fmt.Errorf("banned, but failed to delete: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Backend) AllowEvent(ctx context.Context, id string, reason string) error {
+	if !nostr.IsValid32ByteHex(id) {
+		return fmt.Errorf("invalid event id '%s'", id)
+	}
+	return b.update(ctx, func(state *State) error {
+		delete(state.BannedEvents, id)
+		state.AllowedEvents[id] = reason
+		return nil
+	})
+}
+
+func (b *Backend) ListBannedEvents(ctx context.Context) ([]nip86.IDReason, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return idReasons(b.state.BannedEvents), nil
+}
+
+func (b *Backend) ListAllowedEvents(ctx context.Context) ([]nip86.IDReason, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return idReasons(b.state.AllowedEvents), nil
+}
+
+func (b *Backend) ChangeRelayName(ctx context.Context, name string) error {
+	if err := b.update(ctx, func(state *State) error {
+		state.Name = name
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	b.applyInfo()
+	b.mu.RUnlock()
+	return nil
+}
+
+func (b *Backend) ChangeRelayDescription(ctx context.Context, desc string) error {
+	if err := b.update(ctx, func(state *State) error {
+		state.Description = desc
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	b.applyInfo()
+	b.mu.RUnlock()
+	return nil
+}
+
+func (b *Backend) ChangeRelayIcon(ctx context.Context, icon string) error {
+	if err := b.update(ctx, func(state *State) error {
+		state.Icon = icon
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	b.applyInfo()
+	b.mu.RUnlock()
+	return nil
+}
+
+func (b *Backend) AllowKind(ctx context.Context, kind int) error {
+	return b.update(ctx, func(state *State) error {
+		state.DisallowedKinds = slices.DeleteFunc(state.DisallowedKinds, func(k int) bool { return k == kind })
+		if !slices.Contains(state.AllowedKinds, kind) {
+			state.AllowedKinds = append(state.AllowedKinds, kind)
+			slices.Sort(state.AllowedKinds)
+		}
+		return nil
+	})
+}
+
+func (b *Backend) DisallowKind(ctx context.Context, kind int) error {
+	return b.update(ctx, func(state *State) error {
+		state.AllowedKinds = slices.DeleteFunc(state.AllowedKinds, func(k int) bool { return k == kind })
+		if !slices.Contains(state.DisallowedKinds, kind) {
+			state.DisallowedKinds = append(state.DisallowedKinds, kind)
+			slices.Sort(state.DisallowedKinds)
+		}
+		return nil
+	})
+}
+
+func (b *Backend) ListAllowedKinds(ctx context.Context) ([]int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return slices.Clone(b.state.AllowedKinds), nil
+}
+
+func (b *Backend) ListDisallowedKinds(ctx context.Context) ([]int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return slices.Clone(b.state.DisallowedKinds), nil
+}
+
+func (b *Backend) BlockIP(ctx context.Context, ip net.IP, reason string) error {
+	return b.update(ctx, func(state *State) error {
+		state.BlockedIPs[ip.String()] = reason
+		return nil
+	})
+}
+
+func (b *Backend) UnblockIP(ctx context.Context, ip net.IP, reason string) error {
+	return b.update(ctx, func(state *State) error {
+		delete(state.BlockedIPs, ip.String())
+		return nil
+	})
+}
+
+func (b *Backend) ListBlockedIPs(ctx context.Context) ([]nip86.IPReason, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	result := make([]nip86.IPReason, 0, len(b.state.BlockedIPs))
+	for _, ip := range slices.Sorted(maps.Keys(b.state.BlockedIPs)) {
+		result = append(result, nip86.IPReason{IP: ip, Reason: b.state.BlockedIPs[ip]})
+	}
+	return result, nil
+}
+
+func (b *Backend) GrantAdmin(ctx context.Context, pubkey string, methods []string) error {
+	if !nostr.IsValidPublicKey(pubkey) {
+		return fmt.Errorf("invalid pubkey '%s'", pubkey)
+	}
+	return b.update(ctx, func(state *State) error {
+		granted := slices.Clone(state.Admins[pubkey])
+		for _, method := range methods {
+			if !slices.Contains(granted, method) {
+				granted = append(granted, method)
+			}
+		}
+		slices.Sort(granted)
+		state.Admins[pubkey] = granted
+		return nil
+	})
+}
+
+func (b *Backend) RevokeAdmin(ctx context.Context, pubkey string, methods []string) error {
+	return b.update(ctx, func(state *State) error {
+		granted := slices.DeleteFunc(slices.Clone(state.Admins[pubkey]), func(m string) bool {
+			return slices.Contains(methods, m)
+		})
+		if len(granted) == 0 {
+			delete(state.Admins, pubkey)
+		} else {
+			state.Admins[pubkey] = granted
+		}
+		return nil
+	})
+}
+
+// AdminMethods returns the methods a pubkey was granted with GrantAdmin.
+func (b *Backend) AdminMethods(ctx context.Context, pubkey string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return slices.Clone(b.state.Admins[pubkey]), nil
+}
+
+func (b *Backend) Stats(ctx context.Context) (nip86.Response, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return nip86.Response{
+		Result: map[string]int{
+			"banned_pubkeys":   len(b.state.BannedPubKeys),
+			"allowed_pubkeys":  len(b.state.AllowedPubKeys),
+			"banned_events":    len(b.state.BannedEvents),
+			"allowed_events":   len(b.state.AllowedEvents),
+			"allowed_kinds":    len(b.state.AllowedKinds),
+			"disallowed_kinds": len(b.state.DisallowedKinds),
+			"blocked_ips":      len(b.state.BlockedIPs),
+			"quarantined":      b.held.Size(),
+			"connections":      len(b.relay.GetConnections()),
+		},
+	}, nil
+}
+
+// quarantine persists the events the relay is holding for moderation
+type quarantine struct{ b *Backend }
+
+func (q quarantine) Hold(ctx context.Context, id string, reason string) error {
+	q.b.held.Store(id, reason)
+	if err := q.b.update(ctx, func(state *State) error { return nil }); err != nil {
+		q.b.held.Delete(id)
+		return err
+	}
+	return nil
+}
+
+func (q quarantine) Release(ctx context.Context, id string) error {
+	reason, held := q.b.held.LoadAndDelete(id)
+	if !held {
+		return nil
+	}
+	if err := q.b.update(ctx, func(state *State) error { return nil }); err != nil {
+		q.b.held.Store(id, reason)
+		return err
+	}
+	return nil
+}
+
+func (q quarantine) IsHeld(ctx context.Context, id string) bool {
+	_, held := q.b.held.Load(id)
+	return held
+}
+
+func (q quarantine) List(ctx context.Context) ([]nip86.IDReason, error) {
+	held := make(map[string]string, q.b.held.Size())
+	q.b.held.Range(func(id string, reason string) bool {
+		held[id] = reason
+		return true
+	})
+	return idReasons(held), nil
+}
+
+func pubkeyReasons(m map[string]string) []nip86.PubKeyReason {
+	result := make([]nip86.PubKeyReason, 0, len(m))
+	for _, pubkey := range slices.Sorted(maps.Keys(m)) {
+		result = append(result, nip86.PubKeyReason{PubKey: pubkey, Reason: m[pubkey]})
+	}
+	return result
+}
+
+func idReasons(m map[string]string) []nip86.IDReason {
+	result := make([]nip86.IDReason, 0, len(m))
+	for _, id := range slices.Sorted(maps.Keys(m)) {
+		result = append(result, nip86.IDReason{ID: id, Reason: m[id]})
+	}
+	return result
+}
@@ -0,0 +1,354 @@
+package management
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/stretchr/testify/require"
+)
+
+// call makes a NIP-86 request to the relay, signed by the given key
+func call(t *testing.T, url string, sk string, method string, params ...any) nip86.Response {
+	body, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+	hash := sha256.Sum256(body)
+
+	auth := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      27235,
+		Tags:      nostr.Tags{{"u", url}, {"method", "POST"}, {"payload", hex.EncodeToString(hash[:])}},
+	}
+	auth.Sign(sk)
+	authj, _ := json.Marshal(auth)
+
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(authj))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var result nip86.Response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result
+}
+
+// publish sends an event through a websocket and returns the OK reason, or "" if it was accepted
+func publish(t *testing.T, url string, sk string, kind int) string {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+url[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	evt := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Content: time.Now().String()}
+	evt.Sign(sk)
+	msg, _ := json.Marshal(nostr.EventEnvelope{Event: evt})
+	conn.WriteMessage(websocket.TextMessage, msg)
+
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	ok := nostr.ParseMessage(string(msg)).(*nostr.OKEnvelope)
+	if ok.OK {
+		return ""
+	}
+	return ok.Reason
+}
+
+func TestBackend(t *testing.T) {
+	relaySK := nostr.GeneratePrivateKey()
+	stateStore := &slicestore.SliceStore{}
+	stateStore.Init()
+
+	for name, storage := range map[string]Storage{
+		"file":  FileStorage{Path: filepath.Join(t.TempDir(), "management.json")},
+		"event": EventStorage{Store: stateStore, SecretKey: relaySK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			admin := nostr.GeneratePrivateKey()
+			alice := nostr.GeneratePrivateKey()
+			alicePK, _ := nostr.GetPublicKey(alice)
+			bob := nostr.GeneratePrivateKey()
+			bobPK, _ := nostr.GetPublicKey(bob)
+			carol := nostr.GeneratePrivateKey()
+
+			relay := khatru.NewRelay()
+			_, err := New(ctx, relay, storage)
+			require.NoError(t, err)
+			server := httptest.NewServer(relay)
+			defer server.Close()
+
+			require.Equal(t, "", publish(t, server.URL, alice, 1))
+
+			// bans apply right away
+			require.Equal(t, true, call(t, server.URL, admin, "banpubkey", alicePK, "spam").Result)
+			require.Equal(t, "blocked: this pubkey is banned", publish(t, server.URL, alice, 1))
+
+			require.Equal(t, true, call(t, server.URL, admin, "disallowkind", 7).Result)
+			require.Equal(t, "blocked: kind 7 is not allowed", publish(t, server.URL, bob, 7))
+			require.Equal(t, "", publish(t, server.URL, bob, 1))
+
+			// once someone is allowed everybody else is not
+			require.Equal(t, true, call(t, server.URL, admin, "allowpubkey", bobPK, "friend").Result)
+			require.Equal(t, "blocked: this pubkey is not allowed", publish(t, server.URL, carol, 1))
+			require.Equal(t, "", publish(t, server.URL, bob, 1))
+
+			require.Equal(t, true, call(t, server.URL, admin, "changerelayname", "managed").Result)
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			req.Header.Set("Accept", "application/nostr+json")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			var info nip11.RelayInformationDocument
+			json.NewDecoder(resp.Body).Decode(&info)
+			resp.Body.Close()
+			require.Equal(t, "managed", info.Name)
+
+			// everything is still there after a restart
+			relay2 := khatru.NewRelay()
+			backend2, err := New(ctx, relay2, storage)
+			require.NoError(t, err)
+			banned, _ := backend2.ListBannedPubKeys(ctx)
+			require.Equal(t, []nip86.PubKeyReason{{PubKey: alicePK, Reason: "spam"}}, banned)
+			allowed, _ := backend2.ListAllowedPubKeys(ctx)
+			require.Equal(t, []nip86.PubKeyReason{{PubKey: bobPK, Reason: "friend"}}, allowed)
+			kinds, _ := backend2.ListDisallowedKinds(ctx)
+			require.Equal(t, []int{7}, kinds)
+			require.Equal(t, "managed", relay2.Info.Name)
+
+			// blocked IPs can't connect anymore
+			require.Equal(t, true, call(t, server.URL, admin, "blockip", "127.0.0.1", "").Result)
+			_, _, err = websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	ctx := context.Background()
+	owner := nostr.GeneratePrivateKey()
+	ownerPK, _ := nostr.GetPublicKey(owner)
+	moderator := nostr.GeneratePrivateKey()
+	moderatorPK, _ := nostr.GetPublicKey(moderator)
+	helper := nostr.GeneratePrivateKey()
+	helperPK, _ := nostr.GetPublicKey(helper)
+	stranger := nostr.GeneratePrivateKey()
+	strangerPK, _ := nostr.GetPublicKey(stranger)
+
+	relay := khatru.NewRelay()
+	relay.ManagementAPI.Owners = []string{ownerPK}
+	_, err := New(ctx, relay, FileStorage{Path: filepath.Join(t.TempDir(), "management.json")})
+	require.NoError(t, err)
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	// strangers can't do anything
+	require.Equal(t, []any{}, call(t, server.URL, stranger, "supportedmethods").Result)
+	require.Contains(t, call(t, server.URL, stranger, "banpubkey", strangerPK, "").Error, "unauthorized")
+
+	// owners can do everything
+	require.Contains(t, call(t, server.URL, owner, "supportedmethods").Result, "grantadmin")
+	require.Equal(t, true, call(t, server.URL, owner, "grantadmin", moderatorPK,
+		[]string{"banpubkey", "listbannedpubkeys", "grantadmin"}).Result)
+
+	// admins can only call what they were granted
+	require.ElementsMatch(t, []any{"banpubkey", "listbannedpubkeys", "grantadmin"},
+		call(t, server.URL, moderator, "supportedmethods").Result)
+	require.Equal(t, true, call(t, server.URL, moderator, "banpubkey", strangerPK, "").Result)
+	require.Contains(t, call(t, server.URL, moderator, "allowpubkey", strangerPK, "").Error, "unauthorized")
+
+	// and can only pass on what they have
+	require.Contains(t, call(t, server.URL, moderator, "grantadmin", helperPK, []string{"blockip"}).Error, "unauthorized")
+	require.Equal(t, true, call(t, server.URL, moderator, "grantadmin", helperPK, []string{"listbannedpubkeys"}).Result)
+	require.Len(t, call(t, server.URL, helper, "listbannedpubkeys").Result, 1)
+
+	// revoking takes effect immediately
+	require.Equal(t, true, call(t, server.URL, owner, "revokeadmin", moderatorPK, []string{"banpubkey"}).Result)
+	require.Contains(t, call(t, server.URL, moderator, "banpubkey", helperPK, "").Error, "unauthorized")
+}
+
+func TestAuditLog(t *testing.T) {
+	relaySK := nostr.GeneratePrivateKey()
+	auditStore := &slicestore.SliceStore{}
+	auditStore.Init()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	for name, sink := range map[string]khatru.AuditSink{
+		"file":  FileAuditLog{Path: path},
+		"event": EventAuditLog{Store: auditStore, SecretKey: relaySK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			admin := nostr.GeneratePrivateKey()
+			adminPK, _ := nostr.GetPublicKey(admin)
+			target := nostr.GeneratePrivateKey()
+			targetPK, _ := nostr.GetPublicKey(target)
+
+			relay := khatru.NewRelay()
+			relay.ManagementAPI.AuditLog = []khatru.AuditSink{sink}
+			_, err := New(ctx, relay, FileStorage{Path: filepath.Join(t.TempDir(), "management.json")})
+			require.NoError(t, err)
+			server := httptest.NewServer(relay)
+			defer server.Close()
+
+			require.Contains(t, call(t, server.URL, admin, "supportedmethods").Result, "listauditlog")
+			require.Equal(t, true, call(t, server.URL, admin, "banpubkey", targetPK, "spam").Result)
+			require.Equal(t, true, call(t, server.URL, admin, "allowkind", 1).Result)
+			require.NotEmpty(t, call(t, server.URL, admin, "grantadmin", "nobody", []string{"banpubkey"}).Error)
+
+			entries, err := sink.List(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, entries, 3)
+			require.NoError(t, khatru.VerifyAuditLog(entries))
+			require.Equal(t, "banpubkey", entries[2].Method)
+			require.Equal(t, adminPK, entries[2].PubKey)
+			require.JSONEq(t, `["`+targetPK+`","spam"]`, string(entries[2].Params))
+			require.JSONEq(t, `true`, string(entries[2].Result))
+			require.Equal(t, "", entries[2].Previous)
+			require.Equal(t, "allowkind", entries[1].Method)
+			require.Equal(t, "invalid pubkey 'nobody'", entries[0].Error)
+
+			// the chain continues after a restart
+			relay2 := khatru.NewRelay()
+			relay2.ManagementAPI.AuditLog = []khatru.AuditSink{sink}
+			_, err = New(ctx, relay2, FileStorage{Path: filepath.Join(t.TempDir(), "management.json")})
+			require.NoError(t, err)
+			server2 := httptest.NewServer(relay2)
+			defer server2.Close()
+			require.Equal(t, true, call(t, server2.URL, admin, "disallowkind", 7).Result)
+
+			resp := call(t, server2.URL, admin, "listauditlog", 2)
+			require.Empty(t, resp.Error)
+			listed, _ := json.Marshal(resp.Result)
+			var recent []khatru.AuditEntry
+			require.NoError(t, json.Unmarshal(listed, &recent))
+			require.Len(t, recent, 2)
+			require.Equal(t, "disallowkind", recent[0].Method)
+			require.NoError(t, khatru.VerifyAuditLog(recent))
+
+			// any changes are detected
+			entries, _ = sink.List(ctx, 10)
+			require.Len(t, entries, 4)
+			changed := slices.Clone(entries)
+			changed[2].Params = json.RawMessage(`[1000]`)
+			require.Error(t, khatru.VerifyAuditLog(changed))
+			require.Error(t, khatru.VerifyAuditLog(slices.Delete(slices.Clone(entries), 1, 2)))
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	storage := FileStorage{Path: filepath.Join(t.TempDir(), "management.json")}
+	admin := nostr.GeneratePrivateKey()
+
+	relay := khatru.NewRelay()
+	relay.QuarantineEvent = append(relay.QuarantineEvent,
+		func(ctx context.Context, event *nostr.Event) (bool, string) { return event.Kind == 7, "reaction" })
+	_, err := New(ctx, relay, storage)
+	require.NoError(t, err)
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	require.Equal(t, "", publish(t, server.URL, nostr.GeneratePrivateKey(), 7))
+	held := call(t, server.URL, admin, "listeventsneedingmoderation").Result.([]any)
+	require.Len(t, held, 1)
+	id := held[0].(map[string]any)["id"].(string)
+
+	// the queue survives restarts
+	relay2 := khatru.NewRelay()
+	_, err = New(ctx, relay2, storage)
+	require.NoError(t, err)
+	list, _ := relay2.Quarantine.List(ctx)
+	require.Equal(t, []nip86.IDReason{{ID: id, Reason: "reaction"}}, list)
+
+	require.Equal(t, true, call(t, server.URL, admin, "allowevent", id, "").Result)
+	allowed, _ := relay.ManagementAPI.ListAllowedEvents(ctx)
+	require.Equal(t, []nip86.IDReason{{ID: id}}, allowed)
+	require.Equal(t, []any{}, call(t, server.URL, nostr.GeneratePrivateKey(), "listeventsneedingmoderation").Result)
+}
+
+// slowStorage blocks every save until it's told to go on
+type slowStorage struct {
+	Storage
+	saving chan struct{}
+	done   chan struct{}
+}
+
+func (ss slowStorage) Save(ctx context.Context, state State) error {
+	ss.saving <- struct{}{}
+	<-ss.done
+	return ss.Storage.Save(ctx, state)
+}
+
+func TestSavingDoesNotBlock(t *testing.T) {
+	ctx := context.Background()
+	storage := slowStorage{
+		Storage: FileStorage{Path: filepath.Join(t.TempDir(), "management.json")},
+		saving:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	relay := khatru.NewRelay()
+	b, err := New(ctx, relay, storage)
+	require.NoError(t, err)
+
+	held := make(chan error)
+	go func() { held <- relay.Quarantine.Hold(ctx, "aa", "reason") }()
+	<-storage.saving
+
+	// while the hold is being saved the relay can still check events and filters
+	require.True(t, relay.Quarantine.IsHeld(ctx, "aa"))
+	require.False(t, relay.Quarantine.IsHeld(ctx, "bb"))
+	reject, _ := b.rejectEvent(ctx, &nostr.Event{Kind: 1})
+	require.False(t, reject)
+
+	close(storage.done)
+	require.NoError(t, <-held)
+	list, _ := relay.Quarantine.List(ctx)
+	require.Equal(t, []nip86.IDReason{{ID: "aa", Reason: "reason"}}, list)
+}
+
+func TestEventStorageIsHidden(t *testing.T) {
+	ctx := context.Background()
+	relaySK := nostr.GeneratePrivateKey()
+	relayPK, _ := nostr.GetPublicKey(relaySK)
+	store := &slicestore.SliceStore{}
+	store.Init()
+
+	// the state is in the same store the relay serves
+	relay := khatru.NewRelay()
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	b, err := New(ctx, relay, EventStorage{Store: store, SecretKey: relaySK})
+	require.NoError(t, err)
+	require.NoError(t, b.ChangeRelayName(ctx, "managed"))
+
+	reject := func(filter nostr.Filter) bool {
+		for _, rej := range relay.RejectFilter {
+			if reject, _ := rej(ctx, filter); reject {
+				return true
+			}
+		}
+		return false
+	}
+	require.True(t, reject(nostr.Filter{Kinds: []int{30078}}))
+	require.True(t, reject(nostr.Filter{Kinds: []int{30078}, Authors: []string{relayPK}}))
+	require.True(t, reject(nostr.Filter{Kinds: []int{30078}, Tags: nostr.TagMap{"d": []string{"khatru-management"}}}))
+	require.False(t, reject(nostr.Filter{Kinds: []int{30078}, Tags: nostr.TagMap{"d": []string{"other"}}}))
+	require.False(t, reject(nostr.Filter{Kinds: []int{30078}, Authors: []string{nostr.GeneratePrivateKey()}}))
+	require.False(t, reject(nostr.Filter{Kinds: []int{1}, Authors: []string{relayPK}}))
+}
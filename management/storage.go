@@ -0,0 +1,209 @@
+package management
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// State is everything the management backend knows, it's what gets persisted.
+type State struct {
+	BannedPubKeys   map[string]string `json:"banned_pubkeys"`
+	AllowedPubKeys  map[string]string `json:"allowed_pubkeys"`
+	BannedEvents    map[string]string `json:"banned_events"`
+	AllowedEvents   map[string]string `json:"allowed_events"`
+	AllowedKinds    []int             `json:"allowed_kinds"`
+	DisallowedKinds []int             `json:"disallowed_kinds"`
+	BlockedIPs      map[string]string `json:"blocked_ips"`
+
+	// events waiting for moderation
+	Quarantined map[string]string `json:"quarantined"`
+
+	// pubkeys that were granted access to some methods
+	Admins map[string][]string `json:"admins"`
+
+	// these override the relay's NIP-11 information when set
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+}
+
+func (s *State) init() {
+	if s.BannedPubKeys == nil {
+		s.BannedPubKeys = make(map[string]string)
+	}
+	if s.AllowedPubKeys == nil {
+		s.AllowedPubKeys = make(map[string]string)
+	}
+	if s.BannedEvents == nil {
+		s.BannedEvents = make(map[string]string)
+	}
+	if s.AllowedEvents == nil {
+		s.AllowedEvents = make(map[string]string)
+	}
+	if s.BlockedIPs == nil {
+		s.BlockedIPs = make(map[string]string)
+	}
+	if s.Quarantined == nil {
+		s.Quarantined = make(map[string]string)
+	}
+	if s.Admins == nil {
+		s.Admins = make(map[string][]string)
+	}
+}
+
+// Storage is where the management State is kept between restarts.
+type Storage interface {
+	// Load returns an empty state (and no error) if nothing was saved yet.
+	Load(ctx context.Context) (State, error)
+	Save(ctx context.Context, state State) error
+}
+
+// FileStorage keeps the state as a JSON file.
+type FileStorage struct {
+	Path string
+}
+
+func (fs FileStorage) Load(ctx context.Context) (State, error) {
+	var state State
+	data, err := os.ReadFile(fs.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("invalid management file %s: %w", fs.Path, err)
+	}
+	return state, nil
+}
+
+func (fs FileStorage) Save(ctx context.Context, state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so we never end up with half of it
+	tmp, err := os.CreateTemp(filepath.Dir(fs.Path), filepath.Base(fs.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.Path)
+}
+
+// EventStorage keeps the state as an addressable event signed by the relay in an eventstore.
+//
+// The event has kind 30078 and it is not encrypted, so it should be kept in a store that isn't used
+// for the relay's public events. When it isn't, the backend refuses REQs that ask for this kind from
+// the relay, but queries that don't name any kinds can still return it.
+type EventStorage struct {
+	Store     eventstore.Store
+	SecretKey string
+
+	// defaults to "khatru-management"
+	Identifier string
+}
+
+const stateKind = 30078
+
+func (es EventStorage) identifier() string {
+	if es.Identifier == "" {
+		return "khatru-management"
+	}
+	return es.Identifier
+}
+
+// rejectFilter refuses filters that ask for the state event, for when Store is also serving the relay
+func (es EventStorage) rejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if !slices.Contains(filter.Kinds, stateKind) {
+		return false, ""
+	}
+	if len(filter.Authors) > 0 {
+		pubkey, _ := nostr.GetPublicKey(es.SecretKey)
+		if !slices.Contains(filter.Authors, pubkey) {
+			return false, ""
+		}
+	}
+	if ds, ok := filter.Tags["d"]; ok && !slices.Contains(ds, es.identifier()) {
+		return false, ""
+	}
+	return true, "restricted: the relay's management state is private"
+}
+
+func (es EventStorage) Load(ctx context.Context) (State, error) {
+	var state State
+
+	latest, err := es.latest(ctx)
+	if err != nil || latest == nil {
+		return state, err
+	}
+	if err := json.Unmarshal([]byte(latest.Content), &state); err != nil {
+		return state, fmt.Errorf("invalid management event %s: %w", latest.ID, err)
+	}
+	return state, nil
+}
+
+func (es EventStorage) latest(ctx context.Context) (*nostr.Event, error) {
+	pubkey, err := nostr.GetPublicKey(es.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := es.Store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{stateKind},
+		Authors: []string{pubkey},
+		Tags:    nostr.TagMap{"d": []string{es.identifier()}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *nostr.Event
+	for evt := range ch {
+		if latest == nil || evt.CreatedAt > latest.CreatedAt {
+			latest = evt
+		}
+	}
+	return latest, nil
+}
+
+func (es EventStorage) Save(ctx context.Context, state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// the new version must always be newer, even if we're saving more than once per second
+	createdAt := nostr.Now()
+	if latest, err := es.latest(ctx); err != nil {
+		return err
+	} else if latest != nil && latest.CreatedAt >= createdAt {
+		createdAt = latest.CreatedAt + 1
+	}
+
+	evt := nostr.Event{
+		CreatedAt: createdAt,
+		Kind:      stateKind,
+		Tags:      nostr.Tags{{"d", es.identifier()}},
+		Content:   string(data),
+	}
+	if err := evt.Sign(es.SecretKey); err != nil {
+		return err
+	}
+	return es.Store.ReplaceEvent(ctx, &evt)
+}
@@ -0,0 +1,136 @@
+package khatru
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// Quarantine keeps track of the events that were stored but are waiting for moderation
+// (see the management package for one that persists them). It must be set for QuarantineEvent to work.
+type Quarantine interface {
+	Hold(ctx context.Context, id string, reason string) error
+	Release(ctx context.Context, id string) error
+	IsHeld(ctx context.Context, id string) bool
+	List(ctx context.Context) ([]nip86.IDReason, error)
+}
+
+type memoryQuarantine struct {
+	held *xsync.MapOf[string, string]
+}
+
+// NewMemoryQuarantine keeps the events waiting for moderation only in memory, so when the relay restarts
+// they are forgotten and become visible like all the others, as they are still in the database.
+func NewMemoryQuarantine() Quarantine {
+	return memoryQuarantine{held: xsync.NewMapOf[string, string]()}
+}
+
+func (mq memoryQuarantine) Hold(ctx context.Context, id string, reason string) error {
+	mq.held.Store(id, reason)
+	return nil
+}
+
+func (mq memoryQuarantine) Release(ctx context.Context, id string) error {
+	mq.held.Delete(id)
+	return nil
+}
+
+func (mq memoryQuarantine) IsHeld(ctx context.Context, id string) bool {
+	_, held := mq.held.Load(id)
+	return held
+}
+
+func (mq memoryQuarantine) List(ctx context.Context) ([]nip86.IDReason, error) {
+	list := make([]nip86.IDReason, 0, mq.held.Size())
+	mq.held.Range(func(id string, reason string) bool {
+		list = append(list, nip86.IDReason{ID: id, Reason: reason})
+		return true
+	})
+	return list, nil
+}
+
+// quarantine checks if the event must be held and holds it
+func (rl *Relay) quarantine(ctx context.Context, evt *nostr.Event) (bool, error) {
+	for _, check := range rl.QuarantineEvent {
+		if hold, reason := check(ctx, evt); hold {
+			if rl.Quarantine == nil {
+				// storing it would make it visible right away
+				return false, fmt.Errorf("can't hold events for moderation")
+			}
+			if err := rl.Quarantine.Hold(ctx, evt.ID, reason); err != nil {
+				return false, fmt.Errorf("failed to quarantine: %w", err)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (rl *Relay) isQuarantined(evt *nostr.Event) bool {
+	return rl.Quarantine != nil && rl.Quarantine.IsHeld(context.Background(), evt.ID)
+}
+
+// releaseQuarantined stops hiding an event and returns it if it is stored
+func (rl *Relay) releaseQuarantined(ctx context.Context, id string) (*nostr.Event, error) {
+	if rl.Quarantine == nil || !rl.Quarantine.IsHeld(ctx, id) {
+		return nil, nil
+	}
+	if err := rl.Quarantine.Release(ctx, id); err != nil {
+		return nil, err
+	}
+	return rl.findEvent(ctx, id), nil
+}
+
+// findEvent gets a stored event by its id, or nil
+func (rl *Relay) findEvent(ctx context.Context, id string) *nostr.Event {
+	for _, query := range rl.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			continue
+		}
+		var found *nostr.Event
+		for evt := range ch {
+			found = evt
+		}
+		if found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// allowEvent makes a quarantined event visible and broadcasts it as if it had just arrived
+func (rl *Relay) allowEvent(ctx context.Context, id string) error {
+	evt, err := rl.releaseQuarantined(ctx, id)
+	if err != nil || evt == nil {
+		return err
+	}
+
+	rl.notifyListeners(evt)
+	rl.publishToBroker(evt)
+	return nil
+}
+
+// banEvent deletes an event (quarantined or not) and prevents it from being stored again, unless
+// ManagementAPI.BanEvent is set, in which case that is expected to do it. banned ids are only kept in
+// memory, but the event itself is gone from the database.
+func (rl *Relay) banEvent(ctx context.Context, id string) error {
+	if _, err := rl.releaseQuarantined(ctx, id); err != nil || rl.ManagementAPI.BanEvent != nil {
+		return err
+	}
+
+	rl.bannedEvents.Store(id, struct{}{})
+	evt := rl.findEvent(ctx, id)
+	if evt == nil {
+		return nil
+	}
+	for _, del := range rl.DeleteEvent {
+		if err := del(ctx, evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
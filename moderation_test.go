@@ -0,0 +1,153 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantine(t *testing.T) {
+	relay := NewRelay()
+	store := &lockedStore{}
+	store.Init()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent)
+	relay.Quarantine = NewMemoryQuarantine()
+	relay.QuarantineEvent = append(relay.QuarantineEvent,
+		func(ctx context.Context, event *nostr.Event) (bool, string) {
+			return strings.Contains(event.Content, "http"), "has a link"
+		})
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	read := func() nostr.Envelope {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return nostr.ParseMessage(string(msg))
+	}
+	sk := nostr.GeneratePrivateKey()
+	publish := func(content string) (nostr.Event, *nostr.OKEnvelope) {
+		evt := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: content}
+		evt.Sign(sk)
+		msg, _ := json.Marshal(nostr.EventEnvelope{Event: evt})
+		conn.WriteMessage(websocket.TextMessage, msg)
+		return evt, read().(*nostr.OKEnvelope)
+	}
+	query := func() []string {
+		conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","stored",{"kinds":[1]}]`))
+		contents := make([]string, 0, 2)
+		for {
+			switch env := read().(type) {
+			case *nostr.EventEnvelope:
+				contents = append(contents, env.Event.Content)
+			case *nostr.EOSEEnvelope:
+				conn.WriteMessage(websocket.TextMessage, []byte(`["CLOSE","stored"]`))
+				return contents
+			}
+		}
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","live",{"kinds":[1]}]`))
+	require.IsType(t, new(nostr.EOSEEnvelope), read())
+
+	// quarantined events are accepted, but not broadcasted or served
+	spam, ok := publish("buy at http://spam")
+	require.True(t, ok.OK)
+	link, ok := publish("see http://example.com")
+	require.True(t, ok.OK)
+
+	// while others go through normally (the broadcast comes before the OK)
+	hello := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "hello"}
+	hello.Sign(sk)
+	msg, _ := json.Marshal(nostr.EventEnvelope{Event: hello})
+	conn.WriteMessage(websocket.TextMessage, msg)
+	require.Equal(t, "hello", read().(*nostr.EventEnvelope).Event.Content)
+	require.True(t, read().(*nostr.OKEnvelope).OK)
+	require.Equal(t, []string{"hello"}, query())
+
+	admin := nostr.GeneratePrivateKey()
+	resp := callNIP86(t, server.URL, admin, "listeventsneedingmoderation")
+	require.ElementsMatch(t, []any{
+		map[string]any{"id": spam.ID, "reason": "has a link"},
+		map[string]any{"id": link.ID, "reason": "has a link"},
+	}, resp.Result)
+
+	// allowed events are broadcasted right away
+	require.Equal(t, true, callNIP86(t, server.URL, admin, "allowevent", link.ID, "fine").Result)
+	require.Equal(t, link.Content, read().(*nostr.EventEnvelope).Event.Content)
+	require.ElementsMatch(t, []string{"hello", link.Content}, query())
+
+	// and stay allowed when they are published again
+	msg, _ = json.Marshal(nostr.EventEnvelope{Event: link})
+	conn.WriteMessage(websocket.TextMessage, msg)
+	require.True(t, read().(*nostr.OKEnvelope).OK)
+	require.False(t, relay.Quarantine.IsHeld(context.Background(), link.ID))
+	require.ElementsMatch(t, []string{"hello", link.Content}, query())
+
+	// while a held one that is published again stays held
+	msg, _ = json.Marshal(nostr.EventEnvelope{Event: spam})
+	conn.WriteMessage(websocket.TextMessage, msg)
+	require.True(t, read().(*nostr.OKEnvelope).OK)
+	require.True(t, relay.Quarantine.IsHeld(context.Background(), spam.ID))
+
+	// the same goes for replaceable events
+	publishProfile := func(createdAt nostr.Timestamp) nostr.Event {
+		evt := nostr.Event{CreatedAt: createdAt, Kind: 0, Content: `{"website":"http://example.com"}`}
+		evt.Sign(sk)
+		msg, _ := json.Marshal(nostr.EventEnvelope{Event: evt})
+		conn.WriteMessage(websocket.TextMessage, msg)
+		require.True(t, read().(*nostr.OKEnvelope).OK)
+		return evt
+	}
+	profile := publishProfile(nostr.Now())
+	require.True(t, relay.Quarantine.IsHeld(context.Background(), profile.ID))
+	require.Equal(t, true, callNIP86(t, server.URL, admin, "allowevent", profile.ID, "fine").Result)
+	msg, _ = json.Marshal(nostr.EventEnvelope{Event: profile})
+	conn.WriteMessage(websocket.TextMessage, msg)
+	require.True(t, read().(*nostr.OKEnvelope).OK)
+	require.False(t, relay.Quarantine.IsHeld(context.Background(), profile.ID))
+
+	// and older versions that are not stored are not held either
+	older := publishProfile(profile.CreatedAt - 10)
+	require.False(t, relay.Quarantine.IsHeld(context.Background(), older.ID))
+
+	// banned events are deleted and can't come back
+	require.Equal(t, true, callNIP86(t, server.URL, admin, "banevent", spam.ID, "spam").Result)
+	// (with another key, as the same call in the same second would be seen as a replay)
+	resp = callNIP86(t, server.URL, nostr.GeneratePrivateKey(), "listeventsneedingmoderation")
+	require.Empty(t, resp.Error)
+	require.Equal(t, []any{}, resp.Result)
+	n, _ := store.CountEvents(context.Background(), nostr.Filter{IDs: []string{spam.ID}})
+	require.Equal(t, int64(0), n)
+
+	msg, _ = json.Marshal(nostr.EventEnvelope{Event: spam})
+	conn.WriteMessage(websocket.TextMessage, msg)
+	ok = read().(*nostr.OKEnvelope)
+	require.False(t, ok.OK)
+	require.Equal(t, "blocked: this event was banned", ok.Reason)
+
+	// events that were never held can be banned too
+	require.Equal(t, true, callNIP86(t, server.URL, admin, "banevent", hello.ID, "changed my mind").Result)
+	n, _ = store.CountEvents(context.Background(), nostr.Filter{IDs: []string{hello.ID}})
+	require.Equal(t, int64(0), n)
+
+	// and without anywhere to hold them these events are rejected
+	relay.Quarantine = nil
+	_, ok = publish("more http://spam")
+	require.False(t, ok.OK)
+	require.Equal(t, "error: can't hold events for moderation", ok.Reason)
+}
@@ -43,6 +43,10 @@ func (rl *Relay) startNegentropySession(ctx context.Context, filter nostr.Filter
 		}
 
 		for event := range ch {
+			if isExpired(event) || rl.isQuarantined(event) {
+				continue
+			}
+
 			// since the goal here is to sync databases we won't do fancy stuff like overwrite events
 			vec.Insert(event.CreatedAt, event.ID)
 		}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
 )
 
 func (rl *Relay) HandleNIP11(w http.ResponseWriter, r *http.Request) {
@@ -21,6 +23,21 @@ func (rl *Relay) HandleNIP11(w http.ResponseWriter, r *http.Request) {
 		info.AddSupportedNIP(77)
 	}
 
+	// advertise our limits without modifying the original document
+	if rl.MaxSubscriptionsPerConnection > 0 || rl.MaxFiltersPerReq > 0 {
+		limitation := nip11.RelayLimitationDocument{}
+		if info.Limitation != nil {
+			limitation = *info.Limitation
+		}
+		if rl.MaxSubscriptionsPerConnection > 0 {
+			limitation.MaxSubscriptions = rl.MaxSubscriptionsPerConnection
+		}
+		if rl.MaxFiltersPerReq > 0 {
+			limitation.MaxFilters = rl.MaxFiltersPerReq
+		}
+		info.Limitation = &limitation
+	}
+
 	// resolve relative icon and banner URLs against base URL
 	baseURL := rl.getBaseURL(r)
 	if info.Icon != "" && !strings.HasPrefix(info.Icon, "http://") && !strings.HasPrefix(info.Icon, "https://") {
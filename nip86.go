@@ -2,24 +2,24 @@ package khatru
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"reflect"
-	"strings"
+	"slices"
 
-	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip86"
 )
 
 type RelayManagementAPI struct {
 	RejectAPICall []func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string)
 
+	// when Owners is set only these pubkeys can call all methods, everybody else can only call the
+	// methods returned for them by AdminMethods (which are generally the ones given with GrantAdmin)
+	Owners       []string
+	AdminMethods func(ctx context.Context, pubkey string) ([]string, error)
+
 	BanPubKey                   func(ctx context.Context, pubkey string, reason string) error
 	ListBannedPubKeys           func(ctx context.Context) ([]nip86.PubKeyReason, error)
 	AllowPubKey                 func(ctx context.Context, pubkey string, reason string) error
@@ -43,18 +43,59 @@ type RelayManagementAPI struct {
 	GrantAdmin                  func(ctx context.Context, pubkey string, methods []string) error
 	RevokeAdmin                 func(ctx context.Context, pubkey string, methods []string) error
 	Generic                     func(ctx context.Context, request nip86.Request) (nip86.Response, error)
+
+	// every call (except to "supportedmethods" and "listauditlog") is recorded on all of these,
+	// and the first is used to answer "listauditlog"
+	AuditLog []AuditSink
+
+	// methods added with AddManagementMethod
+	custom map[string]managementMethod
+}
+
+// managementMethod is anything that can be called through the management API
+type managementMethod struct {
+	decode func(params []any) (nip86.MethodParams, error)
+	handle func(ctx context.Context, mp nip86.MethodParams) (any, error)
 }
 
+// AddManagementMethod adds a custom method to the management API (or replaces a built-in one).
+// The method name is taken from the params type, decode turns the raw JSON params into it.
+//
+// This must be called before the relay starts serving requests.
+func AddManagementMethod[P nip86.MethodParams](
+	rl *Relay,
+	decode func(params []any) (P, error),
+	handle func(ctx context.Context, params P) (any, error),
+) {
+	var zero P
+	if rl.ManagementAPI.custom == nil {
+		rl.ManagementAPI.custom = make(map[string]managementMethod)
+	}
+	rl.ManagementAPI.custom[zero.MethodName()] = managementMethod{
+		decode: func(params []any) (nip86.MethodParams, error) { return decode(params) },
+		handle: func(ctx context.Context, mp nip86.MethodParams) (any, error) { return handle(ctx, mp.(P)) },
+	}
+}
+
+// genericCall is what RejectAPICall sees for methods that are handled by Generic
+type genericCall struct{ method string }
+
+func (gc genericCall) MethodName() string { return gc.method }
+
 func (rl *Relay) HandleNIP86(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/nostr+json+rpc")
 
 	var (
-		resp        nip86.Response
-		ctx         = r.Context()
-		req         nip86.Request
-		mp          nip86.MethodParams
-		evt         nostr.Event
-		payloadHash [32]byte
+		resp       nip86.Response
+		ctx        = r.Context()
+		req        nip86.Request
+		mp         nip86.MethodParams
+		pubkey     string
+		allMethods bool
+		granted    []string
+		methods    = rl.managementMethods()
+		method     managementMethod
+		known      bool
 	)
 
 	payload, err := io.ReadAll(r.Body)
@@ -62,41 +103,12 @@ func (rl *Relay) HandleNIP86(w http.ResponseWriter, r *http.Request) {
 		resp.Error = "empty request"
 		goto respond
 	}
-	payloadHash = sha256.Sum256(payload)
-
-	{
-		auth := r.Header.Get("Authorization")
-		spl := strings.Split(auth, "Nostr ")
-		if len(spl) != 2 {
-			resp.Error = "missing auth"
-			goto respond
-		}
-
-		evtj, err := base64.StdEncoding.DecodeString(spl[1])
-		if err != nil {
-			resp.Error = "invalid base64 auth"
-			goto respond
-		}
-		if err := json.Unmarshal(evtj, &evt); err != nil {
-			resp.Error = "invalid auth event json"
-			goto respond
-		}
-		if ok, _ := evt.CheckSignature(); !ok {
-			resp.Error = "invalid auth event"
-			goto respond
-		}
 
-		if uTag := evt.Tags.Find("u"); uTag == nil || nostr.NormalizeURL(rl.getBaseURL(r)) != nostr.NormalizeURL(uTag[1]) {
-			resp.Error = fmt.Sprintf("invalid 'u' tag, got '%s', expected '%s'",
-				nostr.NormalizeURL(rl.getBaseURL(r)), nostr.NormalizeURL(uTag[1]))
-			goto respond
-		} else if pht := evt.Tags.FindWithValue("payload", hex.EncodeToString(payloadHash[:])); pht == nil {
-			resp.Error = "invalid auth event payload hash"
-			goto respond
-		} else if evt.CreatedAt < nostr.Now()-30 {
-			resp.Error = "auth event is too old"
-			goto respond
-		}
+	// the auth event must be for the relay URL
+	pubkey, err = rl.validateNIP98(r, payload, rl.getBaseURL(r))
+	if err != nil {
+		resp.Error = err.Error()
+		goto respond
 	}
 
 	if err := json.Unmarshal(payload, &req); err != nil {
@@ -104,13 +116,50 @@ func (rl *Relay) HandleNIP86(w http.ResponseWriter, r *http.Request) {
 		goto respond
 	}
 
-	mp, err = nip86.DecodeRequest(req)
+	if req.Method == "supportedmethods" {
+		mp = nip86.SupportedMethods{}
+	} else if method, known = methods[req.Method]; known {
+		mp, err = method.decode(req.Params)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid params: %s", err)
+			goto respond
+		}
+	} else if rl.ManagementAPI.Generic != nil {
+		mp = genericCall{req.Method}
+	} else {
+		resp.Error = fmt.Sprintf("method '%s' not known", req.Method)
+		goto respond
+	}
+
+	ctx = context.WithValue(ctx, nip86HeaderAuthKey, pubkey)
+
+	// check if the caller has permission to call this method
+	allMethods, granted, err = rl.ManagementAPI.allowedMethods(ctx, pubkey)
 	if err != nil {
-		resp.Error = fmt.Sprintf("invalid params: %s", err)
+		resp.Error = fmt.Sprintf("failed to check permissions: %s", err)
 		goto respond
+	} else if !allMethods {
+		if name := mp.MethodName(); name != "supportedmethods" && !slices.Contains(granted, name) {
+			resp.Error = fmt.Sprintf("unauthorized: you can't call %s", name)
+			goto respond
+		}
+
+		// and admins can't give away (or take) more than what they have
+		var methods []string
+		switch thing := mp.(type) {
+		case nip86.GrantAdmin:
+			methods = thing.AllowMethods
+		case nip86.RevokeAdmin:
+			methods = thing.DisallowMethods
+		}
+		for _, method := range methods {
+			if !slices.Contains(granted, method) {
+				resp.Error = fmt.Sprintf("unauthorized: you can't call %s yourself", method)
+				goto respond
+			}
+		}
 	}
 
-	ctx = context.WithValue(ctx, nip86HeaderAuthKey, evt.PubKey)
 	for _, rac := range rl.ManagementAPI.RejectAPICall {
 		if reject, msg := rac(ctx, mp); reject {
 			resp.Error = msg
@@ -119,216 +168,228 @@ func (rl *Relay) HandleNIP86(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if _, ok := mp.(nip86.SupportedMethods); ok {
-		mat := reflect.TypeOf(rl.ManagementAPI)
-		mav := reflect.ValueOf(rl.ManagementAPI)
+		// only list what the caller can actually call
+		supported := make([]string, 0, len(methods))
+		for name := range methods {
+			if allMethods || slices.Contains(granted, name) {
+				supported = append(supported, name)
+			}
+		}
+		slices.Sort(supported)
+		resp.Result = supported
+	} else if known {
+		if result, err := method.handle(ctx, mp); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result = result
+		}
+	} else {
+		if result, err := rl.ManagementAPI.Generic(ctx, req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result = result
+		}
+	}
 
-		methods := make([]string, 0, mat.NumField())
-		for i := 0; i < mat.NumField(); i++ {
-			field := mat.Field(i)
-			value := mav.Field(i).Interface()
+respond:
+	if mp != nil && mp.MethodName() != "supportedmethods" && mp.MethodName() != "listauditlog" {
+		rl.audit(ctx, pubkey, req, resp)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
 
-			// danger: this assumes the struct fields are appropriately named
-			methodName := strings.ToLower(field.Name)
+// managementMethods returns all the methods that can be called, keyed by name
+func (rl *Relay) managementMethods() map[string]managementMethod {
+	api := &rl.ManagementAPI
+	methods := make(map[string]managementMethod, 32)
 
-			if methodName == "rejectapicall" {
-				continue
-			}
+	// built-in methods are only available when their handlers are defined
+	builtin := func(name string, defined bool, handle func(ctx context.Context, mp nip86.MethodParams) (any, error)) {
+		if defined {
+			methods[name] = managementMethod{decode: decodeBuiltin(name), handle: handle}
+		}
+	}
 
-			// assign this only if the function was defined
-			if !reflect.ValueOf(value).IsNil() {
-				methods = append(methods, methodName)
-			}
+	builtin("banpubkey", api.BanPubKey != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.BanPubKey)
+		if err := api.BanPubKey(ctx, thing.PubKey, thing.Reason); err != nil {
+			return nil, err
 		}
-		resp.Result = methods
-	} else {
-		switch thing := mp.(type) {
-		case nip86.BanPubKey:
-			if rl.ManagementAPI.BanPubKey == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.BanPubKey(ctx, thing.PubKey, thing.Reason); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ListBannedPubKeys:
-			if rl.ManagementAPI.ListBannedPubKeys == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListBannedPubKeys(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.AllowPubKey:
-			if rl.ManagementAPI.AllowPubKey == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.AllowPubKey(ctx, thing.PubKey, thing.Reason); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ListAllowedPubKeys:
-			if rl.ManagementAPI.ListAllowedPubKeys == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListAllowedPubKeys(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.BanEvent:
-			if rl.ManagementAPI.BanEvent == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.BanEvent(ctx, thing.ID, thing.Reason); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.AllowEvent:
-			if rl.ManagementAPI.AllowEvent == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.AllowEvent(ctx, thing.ID, thing.Reason); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ListEventsNeedingModeration:
-			if rl.ManagementAPI.ListEventsNeedingModeration == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListEventsNeedingModeration(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.ListBannedEvents:
-			if rl.ManagementAPI.ListBannedEvents == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListBannedEvents(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.ChangeRelayName:
-			if rl.ManagementAPI.ChangeRelayName == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.ChangeRelayName(ctx, thing.Name); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ChangeRelayDescription:
-			if rl.ManagementAPI.ChangeRelayDescription == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.ChangeRelayDescription(ctx, thing.Description); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ChangeRelayIcon:
-			if rl.ManagementAPI.ChangeRelayIcon == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.ChangeRelayIcon(ctx, thing.IconURL); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.AllowKind:
-			if rl.ManagementAPI.AllowKind == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.AllowKind(ctx, thing.Kind); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.DisallowKind:
-			if rl.ManagementAPI.DisallowKind == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.DisallowKind(ctx, thing.Kind); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ListAllowedKinds:
-			if rl.ManagementAPI.ListAllowedKinds == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListAllowedKinds(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.BlockIP:
-			if rl.ManagementAPI.BlockIP == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.BlockIP(ctx, thing.IP, thing.Reason); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.UnblockIP:
-			if rl.ManagementAPI.UnblockIP == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.UnblockIP(ctx, thing.IP, thing.Reason); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ListBlockedIPs:
-			if rl.ManagementAPI.ListBlockedIPs == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListBlockedIPs(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.Stats:
-			if rl.ManagementAPI.Stats == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.Stats(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.GrantAdmin:
-			if rl.ManagementAPI.GrantAdmin == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.GrantAdmin(ctx, thing.Pubkey, thing.AllowMethods); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.RevokeAdmin:
-			if rl.ManagementAPI.RevokeAdmin == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if err := rl.ManagementAPI.RevokeAdmin(ctx, thing.Pubkey, thing.DisallowMethods); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = true
-			}
-		case nip86.ListDisallowedKinds:
-			if rl.ManagementAPI.ListDisAllowedKinds == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListDisAllowedKinds(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
-			}
-		case nip86.ListAllowedEvents:
-			if rl.ManagementAPI.ListAllowedEvents == nil {
-				resp.Error = fmt.Sprintf("method %s not supported", thing.MethodName())
-			} else if result, err := rl.ManagementAPI.ListAllowedEvents(ctx); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
+
+		// kick any live sessions from this pubkey
+		for _, ws := range rl.GetConnectionsByAuthed(thing.PubKey) {
+			rl.Disconnect(ws, "banned")
+		}
+		return true, nil
+	})
+	builtin("listbannedpubkeys", api.ListBannedPubKeys != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListBannedPubKeys(ctx)
+	})
+	builtin("allowpubkey", api.AllowPubKey != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.AllowPubKey)
+		return done(api.AllowPubKey(ctx, thing.PubKey, thing.Reason))
+	})
+	builtin("listallowedpubkeys", api.ListAllowedPubKeys != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListAllowedPubKeys(ctx)
+	})
+	// these are also available when the relay is quarantining events
+	moderating := len(rl.QuarantineEvent) > 0 && rl.Quarantine != nil
+	builtin("banevent", api.BanEvent != nil || moderating, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.BanEvent)
+		if api.BanEvent != nil {
+			if err := api.BanEvent(ctx, thing.ID, thing.Reason); err != nil {
+				return nil, err
 			}
-		default:
-			if rl.ManagementAPI.Generic == nil {
-				resp.Error = fmt.Sprintf("method '%s' not known", mp.MethodName())
-			} else if result, err := rl.ManagementAPI.Generic(ctx, req); err != nil {
-				resp.Error = err.Error()
-			} else {
-				resp.Result = result
+		}
+		return done(rl.banEvent(ctx, thing.ID))
+	})
+	builtin("allowevent", api.AllowEvent != nil || moderating, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.AllowEvent)
+		if api.AllowEvent != nil {
+			if err := api.AllowEvent(ctx, thing.ID, thing.Reason); err != nil {
+				return nil, err
 			}
 		}
+		return done(rl.allowEvent(ctx, thing.ID))
+	})
+	builtin("listeventsneedingmoderation", api.ListEventsNeedingModeration != nil || moderating, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		if api.ListEventsNeedingModeration != nil {
+			return api.ListEventsNeedingModeration(ctx)
+		}
+		return rl.Quarantine.List(ctx)
+	})
+	builtin("listbannedevents", api.ListBannedEvents != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListBannedEvents(ctx)
+	})
+	builtin("listallowedevents", api.ListAllowedEvents != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListAllowedEvents(ctx)
+	})
+	builtin("changerelayname", api.ChangeRelayName != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return done(api.ChangeRelayName(ctx, mp.(nip86.ChangeRelayName).Name))
+	})
+	builtin("changerelaydescription", api.ChangeRelayDescription != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return done(api.ChangeRelayDescription(ctx, mp.(nip86.ChangeRelayDescription).Description))
+	})
+	builtin("changerelayicon", api.ChangeRelayIcon != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return done(api.ChangeRelayIcon(ctx, mp.(nip86.ChangeRelayIcon).IconURL))
+	})
+	builtin("allowkind", api.AllowKind != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return done(api.AllowKind(ctx, mp.(nip86.AllowKind).Kind))
+	})
+	builtin("disallowkind", api.DisallowKind != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return done(api.DisallowKind(ctx, mp.(nip86.DisallowKind).Kind))
+	})
+	builtin("listallowedkinds", api.ListAllowedKinds != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListAllowedKinds(ctx)
+	})
+	builtin("listdisallowedkinds", api.ListDisAllowedKinds != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListDisAllowedKinds(ctx)
+	})
+	builtin("blockip", api.BlockIP != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.BlockIP)
+		if err := api.BlockIP(ctx, thing.IP, thing.Reason); err != nil {
+			return nil, err
+		}
+
+		// kick any live sessions from this IP
+		for _, ws := range rl.GetConnectionsByIP(thing.IP.String()) {
+			rl.Disconnect(ws, "blocked")
+		}
+		return true, nil
+	})
+	builtin("unblockip", api.UnblockIP != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.UnblockIP)
+		return done(api.UnblockIP(ctx, thing.IP, thing.Reason))
+	})
+	builtin("listblockedips", api.ListBlockedIPs != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.ListBlockedIPs(ctx)
+	})
+	builtin("stats", api.Stats != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		return api.Stats(ctx)
+	})
+	builtin("grantadmin", api.GrantAdmin != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.GrantAdmin)
+		return done(api.GrantAdmin(ctx, thing.Pubkey, thing.AllowMethods))
+	})
+	builtin("revokeadmin", api.RevokeAdmin != nil, func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+		thing := mp.(nip86.RevokeAdmin)
+		return done(api.RevokeAdmin(ctx, thing.Pubkey, thing.DisallowMethods))
+	})
+
+	if len(api.AuditLog) > 0 {
+		methods["listauditlog"] = managementMethod{
+			decode: func(params []any) (nip86.MethodParams, error) { return decodeListAuditLog(params) },
+			handle: func(ctx context.Context, mp nip86.MethodParams) (any, error) {
+				return api.AuditLog[0].List(ctx, mp.(ListAuditLog).Limit)
+			},
+		}
 	}
 
-respond:
-	json.NewEncoder(w).Encode(resp)
+	for name, method := range api.custom {
+		methods[name] = method
+	}
+
+	return methods
+}
+
+// done is the result of methods that don't return anything
+func done(err error) (any, error) {
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// decodeBuiltin decodes params for the methods defined by NIP-86
+func decodeBuiltin(method string) func(params []any) (nip86.MethodParams, error) {
+	return func(params []any) (nip86.MethodParams, error) {
+		req := nip86.Request{Method: method, Params: params}
+
+		// params decoded from JSON don't have the types nip86.DecodeRequest expects for these
+		if (method == "grantadmin" || method == "revokeadmin") && !normalizeAdminParams(&req) {
+			return nil, fmt.Errorf("invalid params for '%s'", method)
+		}
+
+		return nip86.DecodeRequest(req)
+	}
+}
+
+// allowedMethods returns either true, meaning everything is allowed, or the list of allowed methods
+func (api RelayManagementAPI) allowedMethods(ctx context.Context, pubkey string) (all bool, methods []string, err error) {
+	if len(api.Owners) == 0 || slices.Contains(api.Owners, pubkey) {
+		return true, nil, nil
+	}
+	if api.AdminMethods == nil {
+		return false, nil, nil
+	}
+	methods, err = api.AdminMethods(ctx, pubkey)
+	return false, methods, err
+}
+
+// normalizeAdminParams turns the list of methods into a []string
+func normalizeAdminParams(req *nip86.Request) bool {
+	if len(req.Params) < 2 {
+		return false
+	}
+	if _, ok := req.Params[0].(string); !ok {
+		return false
+	}
+
+	switch list := req.Params[1].(type) {
+	case []string:
+		return true
+	case []any:
+		methods := make([]string, len(list))
+		for i, item := range list {
+			method, ok := item.(string)
+			if !ok {
+				return false
+			}
+			methods[i] = method
+		}
+		req.Params[1] = methods
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,103 @@
+package khatru
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/stretchr/testify/require"
+)
+
+type kickConnection struct {
+	IP string
+}
+
+func (kickConnection) MethodName() string { return "kickconnection" }
+
+// callNIP86 makes a management API request signed by the given key
+func callNIP86(t *testing.T, url string, sk string, method string, params ...any) nip86.Response {
+	body, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+	hash := sha256.Sum256(body)
+	auth := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      27235,
+		Tags:      nostr.Tags{{"u", url}, {"method", "POST"}, {"payload", hex.EncodeToString(hash[:])}},
+	}
+	auth.Sign(sk)
+	authj, _ := json.Marshal(auth)
+
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(authj))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var result nip86.Response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result
+}
+
+func TestManagementMethods(t *testing.T) {
+	relay := NewRelay()
+	relay.ManagementAPI.ListDisAllowedKinds = func(ctx context.Context) ([]int, error) { return []int{7}, nil }
+	relay.ManagementAPI.BanPubKey = func(ctx context.Context, pubkey string, reason string) error { return nil }
+
+	var kicked string
+	AddManagementMethod(relay,
+		func(params []any) (kickConnection, error) {
+			if len(params) != 1 {
+				return kickConnection{}, fmt.Errorf("expected one ip")
+			}
+			ip, _ := params[0].(string)
+			return kickConnection{IP: ip}, nil
+		},
+		func(ctx context.Context, params kickConnection) (any, error) {
+			kicked = params.IP
+			return len(relay.GetConnectionsByIP(params.IP)), nil
+		},
+	)
+
+	var rejected []nip86.MethodParams
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall,
+		func(ctx context.Context, mp nip86.MethodParams) (bool, string) {
+			rejected = append(rejected, mp)
+			return mp.MethodName() == "forbidden", "no"
+		})
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	call := func(method string, params ...any) nip86.Response {
+		return callNIP86(t, server.URL, sk, method, params...)
+	}
+
+	require.Equal(t, []any{"banpubkey", "kickconnection", "listdisallowedkinds"}, call("supportedmethods").Result)
+	require.Equal(t, []any{float64(7)}, call("listdisallowedkinds").Result)
+
+	// custom methods get their typed params
+	require.Equal(t, float64(0), call("kickconnection", "10.0.0.1").Result)
+	require.Equal(t, "10.0.0.1", kicked)
+	require.Equal(t, kickConnection{IP: "10.0.0.1"}, rejected[len(rejected)-1])
+	require.Contains(t, call("kickconnection").Error, "expected one ip")
+
+	// methods without handlers are not known
+	require.Equal(t, "method 'allowkind' not known", call("allowkind", 1).Error)
+
+	// unless there is a generic handler
+	relay.ManagementAPI.Generic = func(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+		return nip86.Response{Result: request.Method}, nil
+	}
+	require.Equal(t, map[string]any{"result": "somethingelse"}, call("somethingelse").Result)
+	require.Equal(t, "no", call("forbidden").Error)
+}
@@ -0,0 +1,121 @@
+package khatru
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	ErrNIP98MissingAuth = errors.New("missing auth")
+	ErrNIP98Replayed    = errors.New("auth event was already used")
+)
+
+// ValidateNIP98 checks the NIP-98 "Authorization" header of a request and returns the pubkey that signed it.
+// payload is the request body (it can be nil if there isn't one), which must match the "payload" tag.
+//
+// each auth event can only be used once, and it must not be further in the past or in the future than NIP98ClockSkew.
+func (rl *Relay) ValidateNIP98(r *http.Request, payload []byte) (pubkey string, err error) {
+	return rl.validateNIP98(r, payload, strings.TrimRight(rl.getBaseURL(r), "/")+r.URL.RequestURI())
+}
+
+func (rl *Relay) validateNIP98(r *http.Request, payload []byte, expectedURL string) (pubkey string, err error) {
+	auth := r.Header.Get("Authorization")
+	spl := strings.Split(auth, "Nostr ")
+	if len(spl) != 2 {
+		return "", ErrNIP98MissingAuth
+	}
+
+	evtj, err := base64.StdEncoding.DecodeString(spl[1])
+	if err != nil {
+		return "", errors.New("invalid base64 auth")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(evtj, &evt); err != nil {
+		return "", errors.New("invalid auth event json")
+	}
+
+	if evt.Kind != 27235 {
+		return "", fmt.Errorf("auth event must be of kind 27235, not %d", evt.Kind)
+	}
+	if !evt.CheckID() {
+		return "", errors.New("invalid auth event id")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "", errors.New("invalid auth event")
+	}
+
+	skew := nostr.Timestamp(rl.NIP98ClockSkew / time.Second)
+	if now := nostr.Now(); evt.CreatedAt < now-skew {
+		return "", errors.New("auth event is too old")
+	} else if evt.CreatedAt > now+skew {
+		return "", errors.New("auth event is in the future")
+	}
+
+	if uTag := evt.Tags.Find("u"); uTag == nil {
+		return "", errors.New("missing 'u' tag")
+	} else if nostr.NormalizeURL(expectedURL) != nostr.NormalizeURL(uTag[1]) {
+		return "", fmt.Errorf("invalid 'u' tag, got '%s', expected '%s'",
+			nostr.NormalizeURL(uTag[1]), nostr.NormalizeURL(expectedURL))
+	}
+
+	if methodTag := evt.Tags.Find("method"); methodTag == nil || !strings.EqualFold(methodTag[1], r.Method) {
+		return "", fmt.Errorf("invalid 'method' tag, expected '%s'", r.Method)
+	}
+
+	if payloadTag := evt.Tags.Find("payload"); len(payload) > 0 || payloadTag != nil {
+		payloadHash := sha256.Sum256(payload)
+		if payloadTag == nil || !strings.EqualFold(payloadTag[1], hex.EncodeToString(payloadHash[:])) {
+			return "", errors.New("invalid auth event payload hash")
+		}
+	}
+
+	// only now that we know it's valid we remember it
+	if !rl.nip98Seen.add(evt.ID, evt.CreatedAt+skew) {
+		return "", ErrNIP98Replayed
+	}
+
+	return evt.PubKey, nil
+}
+
+// nip98ReplayCache remembers the ids of auth events until they'd be too old to be accepted anyway
+type nip98ReplayCache struct {
+	mu        sync.Mutex
+	seen      map[string]nostr.Timestamp
+	lastSweep nostr.Timestamp
+}
+
+func newNIP98ReplayCache() *nip98ReplayCache {
+	return &nip98ReplayCache{seen: make(map[string]nostr.Timestamp)}
+}
+
+// add returns false if the id was already there
+func (c *nip98ReplayCache) add(id string, expiresAt nostr.Timestamp) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := nostr.Now()
+	if now > c.lastSweep {
+		for id, exp := range c.seen {
+			if exp < now {
+				delete(c.seen, id)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if _, ok := c.seen[id]; ok {
+		return false
+	}
+	c.seen[id] = expiresAt
+	return true
+}
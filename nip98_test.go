@@ -0,0 +1,77 @@
+package khatru
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateNIP98(t *testing.T) {
+	relay := NewRelay()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	body := []byte(`{"hello":"world"}`)
+	hash := sha256.Sum256(body)
+
+	authEvent := func(modify func(evt *nostr.Event)) *nostr.Event {
+		evt := &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      27235,
+			Tags: nostr.Tags{
+				{"u", "https://example.com/upload?x=1"},
+				{"method", "POST"},
+				{"payload", hex.EncodeToString(hash[:])},
+			},
+		}
+		if modify != nil {
+			modify(evt)
+		}
+		evt.Sign(sk)
+		return evt
+	}
+	validate := func(evt *nostr.Event) (string, error) {
+		r := httptest.NewRequest("POST", "https://example.com/upload?x=1", bytes.NewReader(body))
+		j, _ := json.Marshal(evt)
+		r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(j))
+		return relay.ValidateNIP98(r, body)
+	}
+
+	evt := authEvent(nil)
+	pubkey, err := validate(evt)
+	require.NoError(t, err)
+	require.Equal(t, pk, pubkey)
+
+	// the same event can't be used twice
+	_, err = validate(evt)
+	require.ErrorIs(t, err, ErrNIP98Replayed)
+
+	for name, modify := range map[string]func(evt *nostr.Event){
+		"kind":    func(evt *nostr.Event) { evt.Kind = 1 },
+		"method":  func(evt *nostr.Event) { evt.Tags[1][1] = "GET" },
+		"url":     func(evt *nostr.Event) { evt.Tags[0][1] = "https://example.com/upload" },
+		"payload": func(evt *nostr.Event) { evt.Tags[2][1] = hex.EncodeToString(make([]byte, 32)) },
+		"old":     func(evt *nostr.Event) { evt.CreatedAt -= 31 },
+		"future":  func(evt *nostr.Event) { evt.CreatedAt += 31 },
+	} {
+		_, err := validate(authEvent(modify))
+		require.Error(t, err, name)
+	}
+
+	// tampered ids are caught even if the signature would match the real one
+	tampered := authEvent(nil)
+	tampered.ID = hex.EncodeToString(make([]byte, 32))
+	_, err = validate(tampered)
+	require.ErrorContains(t, err, "id")
+
+	// the clock skew is configurable
+	relay.NIP98ClockSkew = 0
+	_, err = validate(authEvent(func(evt *nostr.Event) { evt.CreatedAt += 5 }))
+	require.ErrorContains(t, err, "future")
+}
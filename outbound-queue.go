@@ -0,0 +1,266 @@
+package khatru
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	ErrConnectionClosed           = errors.New("connection closed")
+	ErrSubscriptionClosedSlowness = errors.New("subscription closed because the client was too slow")
+)
+
+// SlowConsumerPolicy defines what happens when we try to broadcast an event to a client whose
+// outbound queue is already full.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest broadcasted event in the queue to make room for the new one.
+	DropOldest SlowConsumerPolicy = iota
+
+	// CloseSlowSubscriptions discards all the queued broadcasted events belonging to the subscription of the
+	// oldest one in the queue and sends a CLOSED for it, repeating this until there is room.
+	//
+	// With both policies the replies to the client's own messages (OK, EOSE, CLOSED, etc) are never discarded.
+	CloseSlowSubscriptions
+
+	// DisconnectSlowClients closes the connection.
+	DisconnectSlowClients
+)
+
+// OutboundStats are counters of what has happened to slow clients since the relay was started.
+type OutboundStats struct {
+	DroppedMessages     uint64
+	ClosedSubscriptions uint64
+	Disconnects         uint64
+}
+
+type outboundStats struct {
+	droppedMessages     atomic.Uint64
+	closedSubscriptions atomic.Uint64
+	disconnects         atomic.Uint64
+}
+
+func (rl *Relay) OutboundStats() OutboundStats {
+	return OutboundStats{
+		DroppedMessages:     rl.outboundStats.droppedMessages.Load(),
+		ClosedSubscriptions: rl.outboundStats.closedSubscriptions.Load(),
+		Disconnects:         rl.outboundStats.disconnects.Load(),
+	}
+}
+
+type outboundMessage struct {
+	typ            int
+	data           []byte
+	subscriptionID string // empty when this message is not tied to any subscription
+	broadcast      bool   // only these can be dropped, everything else is a reply the client is waiting for
+}
+
+// outboundQueue holds the messages waiting to be written to a client by its writer goroutine
+type outboundQueue struct {
+	mu       sync.Mutex
+	messages []outboundMessage
+	max      int
+
+	ready chan struct{} // signals the writer goroutine that there are messages
+	space chan struct{} // closed (and replaced) whenever the writer takes messages from the queue
+}
+
+func newOutboundQueue(size int) *outboundQueue {
+	size = max(size, 1)
+	return &outboundQueue{
+		messages: make([]outboundMessage, 0, min(size, 64)),
+		max:      size,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func (q *outboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// takeAll is called by the writer goroutine
+func (q *outboundQueue) takeAll() []outboundMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs := q.messages
+	q.messages = make([]outboundMessage, 0, min(q.max, 64))
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	return msgs
+}
+
+// writeLoop is the only place where data is written to the connection (control messages aside)
+func (ws *WebSocket) writeLoop(writeWait time.Duration) {
+	for {
+		select {
+		case <-ws.Context.Done():
+			return
+		case <-ws.queue.ready:
+		}
+
+		for _, msg := range ws.queue.takeAll() {
+			ws.mutex.Lock()
+			if writeWait > 0 {
+				ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			}
+			err := ws.conn.WriteMessage(msg.typ, msg.data)
+			ws.mutex.Unlock()
+
+			if err != nil {
+				ws.cancel()
+				ws.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// enqueue waits until there is room in the queue for this message. this is what we do for direct
+// responses to a client's requests, as only the client itself will be slowed down by it.
+func (ws *WebSocket) enqueue(msg outboundMessage) error {
+	q := ws.queue
+	for {
+		q.mu.Lock()
+		if len(q.messages) < q.max {
+			q.messages = append(q.messages, msg)
+			q.mu.Unlock()
+			q.signal()
+			return nil
+		}
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ws.Context.Done():
+			return ErrConnectionClosed
+		}
+	}
+}
+
+// enqueueNow never waits, it is what we do for direct responses when messages are handled by the shared
+// MessageWorkers, as otherwise a client that doesn't read could hold all of them. replies can go over the
+// queue limit, but a client that lets twice as many messages as the limit pile up is disconnected.
+func (ws *WebSocket) enqueueNow(msg outboundMessage) error {
+	q := ws.queue
+	q.mu.Lock()
+	if len(q.messages) >= 2*q.max {
+		q.mu.Unlock()
+		ws.disconnectSlow()
+		return ErrConnectionClosed
+	}
+	q.messages = append(q.messages, msg)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+func (ws *WebSocket) disconnectSlow() {
+	ws.relay.outboundStats.disconnects.Add(1)
+	ws.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client is too slow"),
+		time.Now().Add(time.Second))
+	ws.cancel()
+	ws.conn.Close()
+}
+
+// oldestBroadcast returns the index of the first message that can be dropped, or -1, must be called with q.mu held
+func (q *outboundQueue) oldestBroadcast() int {
+	return slices.IndexFunc(q.messages, func(m outboundMessage) bool { return m.broadcast })
+}
+
+// broadcast never waits: when the queue is full the relay's SlowConsumerPolicy is applied,
+// which only ever drops other broadcasted events, never replies like OK, EOSE or CLOSED.
+func (ws *WebSocket) broadcast(msg outboundMessage) {
+	msg.broadcast = true
+	if ws.queue == nil {
+		ws.WriteMessage(msg.typ, msg.data)
+		return
+	}
+
+	rl := ws.relay
+	q := ws.queue
+
+	q.mu.Lock()
+	if len(q.messages) < q.max {
+		q.messages = append(q.messages, msg)
+		q.mu.Unlock()
+		q.signal()
+		return
+	}
+
+	switch rl.SlowConsumerPolicy {
+	case DropOldest:
+		if oldest := q.oldestBroadcast(); oldest != -1 {
+			q.messages = append(slices.Delete(q.messages, oldest, oldest+1), msg)
+		}
+		// otherwise the queue is full of replies, so it's the new message that is dropped
+		q.mu.Unlock()
+		rl.outboundStats.droppedMessages.Add(1)
+
+	case CloseSlowSubscriptions:
+		closed := make([]string, 0, 1)
+		dropped := 0
+		closeSubscription := func(id string) {
+			closed = append(closed, id)
+			q.messages = slices.DeleteFunc(q.messages, func(m outboundMessage) bool {
+				if m.broadcast && m.subscriptionID == id {
+					dropped++
+					return true
+				}
+				return false
+			})
+		}
+		for len(q.messages) >= q.max {
+			oldest := q.oldestBroadcast()
+			if oldest == -1 {
+				// the queue is full of replies, so we close the subscription of the new message
+				closeSubscription(msg.subscriptionID)
+				break
+			}
+			closeSubscription(q.messages[oldest].subscriptionID)
+		}
+
+		// these CLOSED messages are allowed to go slightly over the limit
+		for _, id := range closed {
+			data, _ := json.Marshal(nostr.ClosedEnvelope{SubscriptionID: id, Reason: "error: client is too slow"})
+			q.messages = append(q.messages, outboundMessage{typ: websocket.TextMessage, data: data})
+		}
+		if slices.Contains(closed, msg.subscriptionID) {
+			dropped++
+		} else {
+			q.messages = append(q.messages, msg)
+		}
+		q.mu.Unlock()
+		q.signal()
+
+		rl.outboundStats.droppedMessages.Add(uint64(dropped))
+		rl.outboundStats.closedSubscriptions.Add(uint64(len(closed)))
+		go func() {
+			for _, id := range closed {
+				rl.removeListenerIdWithCause(ws, id, ErrSubscriptionClosedSlowness)
+			}
+		}()
+
+	case DisconnectSlowClients:
+		q.mu.Unlock()
+		ws.disconnectSlow()
+	}
+}
@@ -0,0 +1,141 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	eventMessage := func(id string, content string) outboundMessage {
+		data, _ := json.Marshal(nostr.EventEnvelope{SubscriptionID: &id, Event: nostr.Event{Content: content}})
+		return outboundMessage{typ: websocket.TextMessage, data: data, subscriptionID: id, broadcast: true}
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		rl := NewRelay()
+		ws := &WebSocket{queue: newOutboundQueue(3), relay: rl}
+
+		for i, c := range []string{"a", "b", "c", "d", "e"} {
+			ws.broadcast(eventMessage("sub", c))
+			require.LessOrEqual(t, len(ws.queue.messages), 3, i)
+		}
+
+		require.Equal(t, []outboundMessage{eventMessage("sub", "c"), eventMessage("sub", "d"), eventMessage("sub", "e")}, ws.queue.messages)
+		require.Equal(t, OutboundStats{DroppedMessages: 2}, rl.OutboundStats())
+	})
+
+	t.Run("close slow subscriptions", func(t *testing.T) {
+		rl := NewRelay()
+		rl.SlowConsumerPolicy = CloseSlowSubscriptions
+		ws := &WebSocket{queue: newOutboundQueue(3), relay: rl}
+		ws.Context, ws.cancel = context.WithCancel(context.Background())
+		defer ws.cancel()
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		rl.shards[0].clients[ws] = nil
+		rl.addListener(ws, "slow", rl, nostr.Filter{Kinds: []int{1}}, cancel)
+		rl.addListener(ws, "other", rl, nostr.Filter{Kinds: []int{1}}, func(cause error) {})
+
+		ws.broadcast(eventMessage("slow", "a"))
+		ws.broadcast(eventMessage("other", "b"))
+		ws.broadcast(eventMessage("slow", "c"))
+		ws.broadcast(eventMessage("other", "d"))
+
+		closed, _ := json.Marshal(nostr.ClosedEnvelope{SubscriptionID: "slow", Reason: "error: client is too slow"})
+		require.Equal(t, []outboundMessage{
+			eventMessage("other", "b"),
+			{typ: websocket.TextMessage, data: closed},
+			eventMessage("other", "d"),
+		}, ws.queue.messages)
+
+		<-ctx.Done()
+		require.ErrorIs(t, context.Cause(ctx), ErrSubscriptionClosedSlowness)
+		require.Equal(t, OutboundStats{DroppedMessages: 2, ClosedSubscriptions: 1}, rl.OutboundStats())
+
+		rl.shards[0].listenersMutex.RLock()
+		require.Len(t, rl.shards[0].listeners, 1)
+		require.Equal(t, "other", rl.shards[0].listeners[0].id)
+		rl.shards[0].listenersMutex.RUnlock()
+	})
+
+	t.Run("replies are never dropped", func(t *testing.T) {
+		rl := NewRelay()
+		ws := &WebSocket{queue: newOutboundQueue(3), relay: rl}
+		ws.Context, ws.cancel = context.WithCancel(context.Background())
+		defer ws.cancel()
+
+		require.NoError(t, ws.WriteJSON(nostr.OKEnvelope{EventID: "x", OK: true}))
+		ws.broadcast(eventMessage("sub", "a"))
+		require.NoError(t, ws.WriteJSON(nostr.EOSEEnvelope("sub")))
+		ws.broadcast(eventMessage("sub", "b"))
+		ws.broadcast(eventMessage("sub", "c"))
+
+		// only the broadcasted event could go
+		require.Len(t, ws.queue.messages, 3)
+		require.Equal(t, eventMessage("sub", "c"), ws.queue.messages[2])
+		ok, _ := json.Marshal(nostr.OKEnvelope{EventID: "x", OK: true})
+		require.Equal(t, ok, ws.queue.messages[0].data)
+
+		// and when there are only replies the new event is the one dropped
+		ws.queue.takeAll()
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, ws.WriteJSON(nostr.EOSEEnvelope(id)))
+		}
+		ws.broadcast(eventMessage("sub", "d"))
+		require.Len(t, ws.queue.messages, 3)
+		require.False(t, slices.ContainsFunc(ws.queue.messages, func(m outboundMessage) bool { return m.broadcast }))
+		require.Equal(t, OutboundStats{DroppedMessages: 3}, rl.OutboundStats())
+
+		// events written directly without a subscription id are fine
+		require.NotPanics(t, func() { ws.queue.takeAll(); ws.WriteJSON(nostr.EventEnvelope{Event: nostr.Event{}}) })
+	})
+
+	t.Run("direct responses on shared workers never wait", func(t *testing.T) {
+		rl := NewRelay()
+		rl.MessageWorkers = 2
+		ws := &WebSocket{queue: newOutboundQueue(2), relay: rl}
+		ws.Context, ws.cancel = context.WithCancel(context.Background())
+		defer ws.cancel()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := range 4 {
+				require.NoError(t, ws.WriteJSON(nostr.NoticeEnvelope(fmt.Sprint(i))))
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("a shared worker would be stuck")
+		}
+		require.Len(t, ws.queue.messages, 4)
+	})
+
+	t.Run("direct responses wait for room", func(t *testing.T) {
+		rl := NewRelay()
+		ws := &WebSocket{queue: newOutboundQueue(1), relay: rl}
+		ws.Context, ws.cancel = context.WithCancel(context.Background())
+
+		require.NoError(t, ws.WriteJSON(nostr.NoticeEnvelope("first")))
+
+		done := make(chan error)
+		go func() { done <- ws.WriteJSON(nostr.NoticeEnvelope("second")) }()
+
+		ws.queue.takeAll()
+		require.NoError(t, <-done)
+		require.Len(t, ws.queue.messages, 1)
+
+		go func() { done <- ws.WriteJSON(nostr.NoticeEnvelope("third")) }()
+		ws.cancel()
+		require.ErrorIs(t, <-done, ErrConnectionClosed)
+	})
+}
@@ -8,12 +8,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fasthttp/websocket"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+	"github.com/puzpuzpuz/xsync/v3"
 )
 
 func NewRelay() *Relay {
@@ -25,7 +27,7 @@ func NewRelay() *Relay {
 		Info: &nip11.RelayInformationDocument{
 			Software:      "https://github.com/fiatjaf/khatru",
 			Version:       "n/a",
-			SupportedNIPs: []any{1, 11, 40, 42, 70, 86},
+			SupportedNIPs: []any{1, 11, 40, 42, 62, 70, 86},
 		},
 
 		upgrader: websocket.Upgrader{
@@ -34,15 +36,25 @@ func NewRelay() *Relay {
 			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
 
-		clients:   make(map[*WebSocket][]listenerSpec, 100),
-		listeners: make([]listener, 0, 100),
-
 		serveMux: &http.ServeMux{},
 
 		WriteWait:      10 * time.Second,
 		PongWait:       60 * time.Second,
 		PingPeriod:     30 * time.Second,
 		MaxMessageSize: 512000,
+
+		NIP98ClockSkew: 30 * time.Second,
+		nip98Seen:      newNIP98ReplayCache(),
+
+		MaxOutboundQueue:   1000,
+		SlowConsumerPolicy: DropOldest,
+
+		bannedEvents: xsync.NewMapOf[string, struct{}](),
+		vanished:     xsync.NewMapOf[string, vanishRequest](),
+	}
+
+	for i := range rl.shards {
+		rl.shards[i] = newRegistryShard()
 	}
 
 	rl.expirationManager = newExpirationManager(rl)
@@ -76,14 +88,59 @@ type Relay struct {
 	OverwriteResponseEvent    []func(ctx context.Context, event *nostr.Event)
 	PreventBroadcast          []func(ws *WebSocket, event *nostr.Event) bool
 
+	// events for which any of these return true are stored, but not served or broadcasted until they
+	// are allowed with the "allowevent" management method
+	QuarantineEvent []func(ctx context.Context, event *nostr.Event) (quarantine bool, reason string)
+
+	// keeps the quarantined events, events are rejected instead when this isn't set
+	Quarantine   Quarantine
+	bannedEvents *xsync.MapOf[string, struct{}]
+
 	// these are used when this relays acts as a router
-	routes                []Route
+	routing               sync.RWMutex              // held while listeners are added, so routes can't change in the middle
+	routesGeneration      atomic.Uint64             // changes with the routes, under the routing lock
 	getSubRelayFromEvent  func(*nostr.Event) *Relay // used for handling EVENTs
 	getSubRelayFromFilter func(nostr.Filter) *Relay // used for handling REQs
 
+	getSubRelaysFromFilter func(nostr.Filter) []routedFilter // used for handling REQs when fanning out
+
+	replicate func(ctx context.Context, event *nostr.Event, primary *Relay) // called after EVENTs are accepted
+
+	// when there are multiple QueryEvents functions, setting this will make their results be merged
+	// in a single stream sorted by created_at, without duplicates and limited by the filter's limit
+	MergeQueryResults bool
+
+	// stores that can list just the events that have an "expiration" tag can do it here. none of the
+	// eventstore backends has an index for this, so by default the relay goes through the newest 100000
+	// events of each QueryEvents when it starts, slowly, one page at a time, and expiring events older
+	// than that are hidden when they expire but never deleted
+	QueryExpiringEvents []func(ctx context.Context) (chan *nostr.Event, error)
+
+	// if set, stored events queries that take longer than this are interrupted and the EOSE is sent
+	// with whatever was already loaded, optionally followed by a CLOSED
+	QueryTimeout        time.Duration
+	CloseOnQueryTimeout bool
+
+	// set this to have events broadcasted across multiple instances of this relay
+	Broker     Broker
+	brokerOnce sync.Once
+
+	// the latest request to vanish from each pubkey -- nip62
+	vanished     *xsync.MapOf[string, vanishRequest]
+	vanishedOnce sync.Once
+
+	// NIP-98 auth events (used by the management API and by ValidateNIP98) are only accepted this close to now
+	NIP98ClockSkew time.Duration
+	nip98Seen      *nip98ReplayCache
+
 	// setting up handlers here will enable these methods
 	ManagementAPI RelayManagementAPI
 
+	// the management API audit log chain
+	auditMutex  sync.Mutex
+	auditLoaded bool
+	auditLast   string
+
 	// editing info will affect the NIP-11 responses
 	Info *nip11.RelayInformationDocument
 
@@ -96,9 +153,8 @@ type Relay struct {
 
 	// keep a connection reference to all connected clients for Server.Shutdown
 	// also used for keeping track of who is listening to what
-	clients      map[*WebSocket][]listenerSpec
-	listeners    []listener
-	clientsMutex sync.Mutex
+	shards    [registryShards]*registryShard
+	nextShard atomic.Uint32
 
 	// set this to true to support negentropy
 	Negentropy bool
@@ -114,6 +170,26 @@ type Relay struct {
 	PingPeriod     time.Duration // Send pings to peer with this period. Must be less than pongWait.
 	MaxMessageSize int64         // Maximum message size allowed from peer.
 
+	// per-connection limits (zero means unlimited), these are also advertised on NIP-11
+	MaxSubscriptionsPerConnection int // Maximum number of open subscriptions each client can have.
+	MaxFiltersPerReq              int // Maximum number of filters in a single REQ.
+
+	// incoming message handling options, by default each message is handled in its own goroutine
+	OrderedMessages                    bool // Handle each client's messages sequentially, in the order they were sent (the options below are ignored then).
+	MaxConcurrentMessagesPerConnection int  // Maximum number of messages from a single client being handled at the same time.
+	MessageWorkers                     int  // Number of goroutines shared by all clients for handling messages.
+	MessageQueueSize                   int  // Number of messages that can be waiting for one of the MessageWorkers.
+	workers                            *workerPool
+	workersOnce                        sync.Once
+
+	// outbound queue options
+	MaxOutboundQueue   int                // Maximum number of messages waiting to be written to each peer.
+	SlowConsumerPolicy SlowConsumerPolicy // What to do when broadcasting to a peer whose queue is full.
+	outboundStats      outboundStats
+
+	// serializes replaceable events
+	addressLocks addressLocks
+
 	// NIP-40 expiration manager
 	expirationManager *expirationManager
 }
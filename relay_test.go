@@ -2,13 +2,22 @@ package khatru
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/fasthttp/websocket"
 	"github.com/fiatjaf/eventstore/slicestore"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBasicRelayFunctionality(t *testing.T) {
@@ -390,3 +399,399 @@ func TestBasicRelayFunctionality(t *testing.T) {
 		}
 	})
 }
+
+func TestReqReplacesSubscription(t *testing.T) {
+	relay := NewRelay()
+	store := slicestore.SliceStore{}
+	store.Init()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	readUntil := func(label string) nostr.Envelope {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for {
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			env := nostr.ParseMessage(string(msg))
+			if env.Label() == label {
+				return env
+			}
+		}
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","x",{"kinds":[1]}]`))
+	readUntil("EOSE")
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","x",{"kinds":[2]}]`))
+	readUntil("EOSE")
+
+	subs := relay.Subscriptions()
+	require.Len(t, subs, 1)
+	require.Equal(t, []int{2}, subs[0].Filter.Kinds)
+
+	sk := nostr.GeneratePrivateKey()
+	for _, kind := range []int{1, 2} {
+		evt := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Content: "hello"}
+		evt.Sign(sk)
+		relay.BroadcastEvent(&evt)
+	}
+
+	env := readUntil("EVENT").(*nostr.EventEnvelope)
+	require.Equal(t, "x", *env.SubscriptionID)
+	require.Equal(t, 2, env.Event.Kind)
+}
+
+func TestCloseSubscriptionAndDisconnect(t *testing.T) {
+	relay := NewRelay()
+	disconnected := make(chan struct{})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) { close(disconnected) })
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","x",{"kinds":[1]}]`))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, `["EOSE","x"]`, string(msg))
+
+	require.Len(t, relay.GetConnections(), 1)
+	require.Len(t, relay.GetConnectionsByIP("127.0.0.1"), 1)
+	require.Len(t, relay.GetConnectionsByIP("10.0.0.1"), 0)
+	require.Len(t, relay.GetConnectionsByAuthed(""), 0)
+	ws := relay.GetConnectionsByIP("127.0.0.1")[0]
+
+	require.True(t, relay.CloseSubscription(ws, "x", "we're done here"))
+	require.False(t, relay.CloseSubscription(ws, "x", "we're done here"))
+	require.Len(t, relay.Subscriptions(), 0)
+
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, `["CLOSED","x","error: we're done here"]`, string(msg))
+
+	relay.Disconnect(ws, "bye")
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	require.Equal(t, "bye", err.(*websocket.CloseError).Text)
+
+	select {
+	case <-disconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnDisconnect wasn't called")
+	}
+	require.Len(t, relay.GetConnections(), 0)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	relay := NewRelay()
+	relay.MaxSubscriptionsPerConnection = 2
+	relay.MaxFiltersPerReq = 2
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	send := func(req string) string {
+		conn.WriteMessage(websocket.TextMessage, []byte(req))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return string(msg)
+	}
+
+	require.Equal(t, `["EOSE","a"]`, send(`["REQ","a",{"kinds":[1]}]`))
+	require.Equal(t, `["EOSE","b"]`, send(`["REQ","b",{"kinds":[1]},{"kinds":[2]}]`))
+	require.Equal(t, `["CLOSED","c","rate-limited: too many open subscriptions, the maximum is 2"]`, send(`["REQ","c",{"kinds":[1]}]`))
+	require.Equal(t, `["EOSE","a"]`, send(`["REQ","a",{"kinds":[3]}]`))
+	require.Equal(t, `["CLOSED","b","error: too many filters, the maximum is 2"]`, send(`["REQ","b",{"kinds":[1]},{"kinds":[2]},{"kinds":[3]}]`))
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`["CLOSE","a"]`))
+	require.Eventually(t, func() bool {
+		return !slices.ContainsFunc(relay.Subscriptions(), func(sub Subscription) bool { return sub.ID == "a" })
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, `["EOSE","c"]`, send(`["REQ","c",{"kinds":[1]}]`))
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var info nip11.RelayInformationDocument
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	require.Equal(t, 2, info.Limitation.MaxSubscriptions)
+	require.Equal(t, 2, info.Limitation.MaxFilters)
+	require.Nil(t, relay.Info.Limitation)
+}
+
+func TestMergeQueryResults(t *testing.T) {
+	relay := NewRelay()
+	relay.MergeQueryResults = true
+
+	store1 := slicestore.SliceStore{}
+	store1.Init()
+	store2 := slicestore.SliceStore{}
+	store2.Init()
+	relay.QueryEvents = append(relay.QueryEvents, store1.QueryEvents, store2.QueryEvents)
+
+	sk := nostr.GeneratePrivateKey()
+	ctx := context.Background()
+	for i := 1; i <= 10; i++ {
+		evt := nostr.Event{CreatedAt: nostr.Timestamp(1000 + i), Kind: 1, Content: strconv.Itoa(i)}
+		evt.Sign(sk)
+		switch i % 3 {
+		case 0:
+			store1.SaveEvent(ctx, &evt)
+		case 1:
+			store2.SaveEvent(ctx, &evt)
+		case 2:
+			// this one is in both
+			store1.SaveEvent(ctx, &evt)
+			store2.SaveEvent(ctx, &evt)
+		}
+	}
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	query := func(req string) []string {
+		conn.WriteMessage(websocket.TextMessage, []byte(req))
+		contents := make([]string, 0, 10)
+		for {
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			switch env := nostr.ParseMessage(string(msg)).(type) {
+			case *nostr.EventEnvelope:
+				contents = append(contents, env.Event.Content)
+			case *nostr.EOSEEnvelope:
+				return contents
+			}
+		}
+	}
+
+	require.Equal(t, []string{"10", "9", "8", "7", "6", "5", "4", "3", "2", "1"}, query(`["REQ","all",{"kinds":[1]}]`))
+	require.Equal(t, []string{"10", "9", "8", "7"}, query(`["REQ","limited",{"kinds":[1],"limit":4}]`))
+	require.Equal(t, []string{"5", "4", "3"}, query(`["REQ","range",{"until":1005,"limit":3}]`))
+}
+
+func TestQueryTimeoutAndStoreErrors(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	evt := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "partial"}
+	evt.Sign(sk)
+
+	gate := make(chan struct{})
+	stubbornDone := make(chan struct{})
+
+	connect := func(closeOnTimeout bool) (*Relay, func(string), func() nostr.Envelope) {
+		relay := NewRelay()
+		relay.QueryTimeout = 200 * time.Millisecond
+		relay.CloseOnQueryTimeout = closeOnTimeout
+		relay.QueryEvents = append(relay.QueryEvents,
+			func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+				if filter.Search == "fail" {
+					return nil, fmt.Errorf("database is down")
+				}
+
+				if filter.Search == "stubborn" {
+					// a store that ignores the context and insists on sending everything
+					ch := make(chan *nostr.Event)
+					go func() {
+						defer close(stubbornDone)
+						defer close(ch)
+						ch <- &evt
+						<-gate
+						for i := 0; i < 3; i++ {
+							ch <- &evt
+						}
+					}()
+					return ch, nil
+				}
+
+				// a store that yields one event and then hangs until the context is canceled
+				ch := make(chan *nostr.Event)
+				go func() {
+					defer close(ch)
+					ch <- &evt
+					<-ctx.Done()
+				}()
+				return ch, nil
+			},
+		)
+
+		server := httptest.NewServer(relay)
+		t.Cleanup(server.Close)
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+		send := func(req string) {
+			conn.WriteMessage(websocket.TextMessage, []byte(req))
+		}
+		read := func() nostr.Envelope {
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			return nostr.ParseMessage(string(msg))
+		}
+		return relay, send, read
+	}
+
+	// partial results followed by EOSE
+	relay, send, read := connect(false)
+	start := time.Now()
+	send(`["REQ","slow",{"kinds":[1]}]`)
+	require.Equal(t, "partial", read().(*nostr.EventEnvelope).Event.Content)
+	require.IsType(t, new(nostr.EOSEEnvelope), read())
+	require.Less(t, time.Since(start), time.Second)
+	require.Len(t, relay.Subscriptions(), 1)
+
+	// store errors end the subscription with CLOSED
+	send(`["REQ","broken",{"kinds":[1],"search":"fail"}]`)
+	closed := read().(*nostr.ClosedEnvelope)
+	require.Equal(t, "broken", closed.SubscriptionID)
+	require.Equal(t, "error: database is down", closed.Reason)
+	require.Len(t, relay.Subscriptions(), 1)
+
+	// optionally the timed out subscription can be closed too
+	relay, send, read = connect(true)
+	send(`["REQ","slow",{"kinds":[1]}]`)
+	require.Equal(t, "partial", read().(*nostr.EventEnvelope).Event.Content)
+	require.IsType(t, new(nostr.EOSEEnvelope), read())
+	closed = read().(*nostr.ClosedEnvelope)
+	require.Equal(t, "slow", closed.SubscriptionID)
+	require.Equal(t, "error: query timed out", closed.Reason)
+	require.Len(t, relay.Subscriptions(), 0)
+
+	// stores are not left hanging when the subscription is closed before they are done
+	send(`["REQ","stubborn",{"kinds":[1],"search":"stubborn"}]`)
+	require.Equal(t, "partial", read().(*nostr.EventEnvelope).Event.Content)
+	send(`["CLOSE","stubborn"]`)
+	require.Eventually(t, func() bool { return len(relay.Subscriptions()) == 0 }, time.Second, 10*time.Millisecond)
+	close(gate)
+	select {
+	case <-stubbornDone:
+	case <-time.After(time.Second):
+		t.Fatal("store is stuck sending events nobody reads")
+	}
+}
+
+func TestMessageConcurrency(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+
+	// sends n events from each of the given number of connections at once
+	// and returns the maximum number of them that were being handled at the same time
+	run := func(relay *Relay, conns int, n int) int32 {
+		var current, peak atomic.Int32
+		relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+			c := current.Add(1)
+			for {
+				p := peak.Load()
+				if c <= p || peak.CompareAndSwap(p, c) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			current.Add(-1)
+			return false, ""
+		})
+
+		server := httptest.NewServer(relay)
+		defer server.Close()
+
+		wg := sync.WaitGroup{}
+		for range conns {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			for i := range n {
+				evt := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: strconv.Itoa(i)}
+				evt.Sign(sk)
+				msg, _ := json.Marshal(nostr.EventEnvelope{Event: evt})
+				conn.WriteMessage(websocket.TextMessage, msg)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range n {
+					_, msg, err := conn.ReadMessage()
+					require.NoError(t, err)
+					require.True(t, nostr.ParseMessage(string(msg)).(*nostr.OKEnvelope).OK)
+				}
+			}()
+		}
+		wg.Wait()
+
+		return peak.Load()
+	}
+
+	t.Run("per connection limit", func(t *testing.T) {
+		relay := NewRelay()
+		relay.MaxConcurrentMessagesPerConnection = 2
+		require.LessOrEqual(t, run(relay, 1, 10), int32(2))
+	})
+
+	t.Run("global worker pool", func(t *testing.T) {
+		relay := NewRelay()
+		relay.MessageWorkers = 3
+		relay.MessageQueueSize = 5
+		require.LessOrEqual(t, run(relay, 3, 10), int32(3))
+	})
+
+	t.Run("ordered", func(t *testing.T) {
+		relay := NewRelay()
+		relay.OrderedMessages = true
+		require.Equal(t, int32(1), run(relay, 1, 5))
+
+		// an EVENT is always stored before a REQ that comes right after it is handled
+		// (this is another relay because the hooks can't be changed after the relay started being used)
+		relay = NewRelay()
+		relay.OrderedMessages = true
+		store := &lockedStore{}
+		store.Init()
+		relay.StoreEvent = append(relay.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
+			time.Sleep(50 * time.Millisecond)
+			return store.SaveEvent(ctx, event)
+		})
+		relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+
+		server := httptest.NewServer(relay)
+		defer server.Close()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+		evt := nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "first"}
+		evt.Sign(sk)
+		msg, _ := json.Marshal(nostr.EventEnvelope{Event: evt})
+		conn.WriteMessage(websocket.TextMessage, msg)
+		conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","after",{"ids":["`+evt.ID+`"]}]`))
+
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		require.IsType(t, new(nostr.OKEnvelope), nostr.ParseMessage(string(msg)))
+		_, msg, err = conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, "first", nostr.ParseMessage(string(msg)).(*nostr.EventEnvelope).Event.Content)
+	})
+}
@@ -4,14 +4,96 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 
+	"github.com/fasthttp/websocket"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
 )
 
-func (rl *Relay) handleRequest(ctx context.Context, id string, eose *sync.WaitGroup, ws *WebSocket, filter nostr.Filter) error {
+func (rl *Relay) handleRequest(
+	ctx context.Context,
+	id string,
+	eose *sync.WaitGroup,
+	timedOut *atomic.Bool,
+	ws *WebSocket,
+	filter nostr.Filter,
+) error {
 	defer eose.Done()
 
+	filter, sources, cancel, err := rl.openQuery(ctx, filter)
+	if err != nil {
+		return err
+	} else if len(sources) == 0 {
+		cancel()
+		return nil
+	}
+
+	if rl.MergeQueryResults && len(sources) > 1 {
+		eose.Add(1)
+		go func() {
+			rl.streamMergedQueries(ctx, id, ws, filter.Limit, sources)
+			if sources[0].ctx.Err() == context.DeadlineExceeded {
+				timedOut.Store(true)
+			}
+			cancel()
+			eose.Done()
+		}()
+		return nil
+	}
+
+	queries := sync.WaitGroup{}
+	queries.Add(len(sources))
+	eose.Add(len(sources))
+	for _, source := range sources {
+		go func(queryCtx context.Context, ch chan *nostr.Event) {
+			for {
+				event, ok := receive(queryCtx, ch)
+				if !ok {
+					break
+				}
+				if isExpired(event) || rl.isQuarantined(event) {
+					// it just wasn't deleted yet, or it is waiting for moderation
+					continue
+				}
+				for _, ovw := range rl.OverwriteResponseEvent {
+					ovw(ctx, event)
+				}
+				ws.WriteMessage(websocket.TextMessage, eventFrame(id, encodeEvent(event)))
+			}
+			if err := queryCtx.Err(); err != nil {
+				// we stopped reading before the store was done (because it took too long, or because the
+				// subscription was closed or replaced) so the rest of the channel must still be consumed
+				if err == context.DeadlineExceeded {
+					timedOut.Store(true)
+				}
+				drain([]chan *nostr.Event{ch})
+			}
+			queries.Done()
+			eose.Done()
+		}(source.ctx, source.ch)
+	}
+	go func() {
+		queries.Wait()
+		cancel()
+	}()
+
+	return nil
+}
+
+// querySource is a channel returned by one of the QueryEvents functions of a relay
+type querySource struct {
+	relay *Relay
+	ctx   context.Context // canceled when we don't need the results anymore or when they take too long
+	ch    chan *nostr.Event
+}
+
+// openQuery applies the filter hooks and starts the queries, it returns no sources if there is nothing
+// to query but cancel must always be called
+func (rl *Relay) openQuery(ctx context.Context, filter nostr.Filter) (nostr.Filter, []querySource, context.CancelFunc, error) {
+	// this may be a sub-relay that is only ever used like this
+	rl.begin()
+
 	// overwrite the filter (for example, to eliminate some kinds or
 	// that we know we don't support)
 	for _, ovw := range rl.OverwriteFilter {
@@ -20,7 +102,7 @@ func (rl *Relay) handleRequest(ctx context.Context, id string, eose *sync.WaitGr
 
 	if filter.LimitZero {
 		// don't do any queries, just subscribe to future events
-		return nil
+		return filter, nil, func() {}, nil
 	}
 
 	// then check if we'll reject this filter (we apply this after overwriting
@@ -29,36 +111,118 @@ func (rl *Relay) handleRequest(ctx context.Context, id string, eose *sync.WaitGr
 	// filter we can just reject it)
 	for _, reject := range rl.RejectFilter {
 		if reject, msg := reject(ctx, filter); reject {
-			return errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
+			return filter, nil, nil, errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
 		}
 	}
 
+	// the stores get a context that is canceled when we don't need them anymore or when they take too long
+	var queryCtx context.Context
+	var cancel context.CancelFunc
+	if rl.QueryTimeout > 0 {
+		queryCtx, cancel = context.WithTimeout(ctx, rl.QueryTimeout)
+	} else {
+		queryCtx, cancel = context.WithCancel(ctx)
+	}
+
 	// run the functions to query events (generally just one,
 	// but we might be fetching stuff from multiple places)
-	eose.Add(len(rl.QueryEvents))
+	sources := make([]querySource, 0, len(rl.QueryEvents))
 	for _, query := range rl.QueryEvents {
-		ch, err := query(ctx, filter)
+		ch, err := query(queryCtx, filter)
 		if err != nil {
-			ws.WriteJSON(nostr.NoticeEnvelope(err.Error()))
-			eose.Done()
-			continue
+			cancel()
+			drainSources(sources)
+			return filter, nil, nil, errors.New(nostr.NormalizeOKMessage(err.Error(), "error"))
 		} else if ch == nil {
-			eose.Done()
 			continue
 		}
+		sources = append(sources, querySource{relay: rl, ctx: queryCtx, ch: ch})
+	}
 
-		go func(ch chan *nostr.Event) {
-			for event := range ch {
-				for _, ovw := range rl.OverwriteResponseEvent {
-					ovw(ctx, event)
-				}
-				ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
+	return filter, sources, cancel, nil
+}
+
+// streamMergedQueries reads from all query channels at the same time, assuming each of them
+// yields events sorted from newest to oldest, and sends a single stream in that same order to the client,
+// without duplicates and respecting the limit across all of them
+func (rl *Relay) streamMergedQueries(
+	ctx context.Context,
+	id string,
+	ws *WebSocket,
+	limit int,
+	sources []querySource,
+) {
+	// we may stop before the stores are done (because of the limit or a timeout)
+	// and in that case we can't leave them hanging
+	defer drainSources(sources)
+
+	// the next event from each channel, nil when the channel is exhausted (or its query was canceled)
+	heads := make([]*nostr.Event, len(sources))
+	for i, source := range sources {
+		heads[i], _ = receive(source.ctx, source.ch)
+	}
+
+	seen := make(map[string]struct{}, max(limit, 100))
+	for sent := 0; limit == 0 || sent < limit; {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// pick the newest among the heads
+		next := -1
+		for i, head := range heads {
+			if head != nil && (next == -1 || isOlder(heads[next], head)) {
+				next = i
 			}
-			eose.Done()
-		}(ch)
+		}
+		if next == -1 {
+			// all channels are exhausted
+			return
+		}
+
+		event := heads[next]
+		source := sources[next]
+		heads[next], _ = receive(source.ctx, source.ch)
+
+		if _, dup := seen[event.ID]; dup || isExpired(event) || source.relay.isQuarantined(event) {
+			continue
+		}
+		seen[event.ID] = struct{}{}
+
+		for _, ovw := range source.relay.OverwriteResponseEvent {
+			ovw(ctx, event)
+		}
+		ws.WriteMessage(websocket.TextMessage, eventFrame(id, encodeEvent(event)))
+		sent++
 	}
+}
 
-	return nil
+// receive returns the next event from a query channel, or false if the channel was closed
+// or the query context was canceled
+func receive(queryCtx context.Context, ch chan *nostr.Event) (*nostr.Event, bool) {
+	select {
+	case event, ok := <-ch:
+		return event, ok
+	case <-queryCtx.Done():
+		return nil, false
+	}
+}
+
+func drainSources(sources []querySource) {
+	for _, source := range sources {
+		drain([]chan *nostr.Event{source.ch})
+	}
+}
+
+// drain consumes whatever is left in query channels in the background, as some stores may ignore
+// the context and would otherwise be stuck forever trying to send us events
+func drain(chans []chan *nostr.Event) {
+	for _, ch := range chans {
+		go func() {
+			for range ch {
+			}
+		}()
+	}
 }
 
 func (rl *Relay) handleCountRequest(ctx context.Context, ws *WebSocket, filter nostr.Filter) int64 {
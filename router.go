@@ -1,45 +1,433 @@
 package khatru
 
 import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/nbd-wtf/go-nostr"
 )
 
-type Router struct{ *Relay }
+type Router struct {
+	*Relay
+
+	// when this is set each filter is sent to all the routes that match it instead of only the first,
+	// filters with multiple kinds are split so each route only gets the kinds it matches
+	FanOut bool
+
+	// writes to replicas that fail with an "error:" are retried this many times, waiting
+	// ReplicaRetryDelay before the first retry and twice as long before each of the next
+	ReplicaRetries    int
+	ReplicaRetryDelay time.Duration
+
+	// routes are never modified, only replaced, so they can be read without locking
+	routes      atomic.Pointer[[]Route]
+	routesMutex sync.Mutex
+}
 
 type Route struct {
+	name          string
+	priority      int
+	hasPriority   bool
 	eventMatcher  func(*nostr.Event) bool
 	filterMatcher func(nostr.Filter) bool
 	relay         *Relay
+	replicas      []*Relay
+	mirror        bool
 }
 
+func (route Route) Name() string { return route.name }
+
 type routeBuilder struct {
 	router        *Router
+	name          string
+	priority      int
+	hasPriority   bool
 	eventMatcher  func(*nostr.Event) bool
 	filterMatcher func(nostr.Filter) bool
+	replicas      []*Relay
+	mirror        bool
 }
 
 func NewRouter() *Router {
-	rr := &Router{Relay: NewRelay()}
-	rr.routes = make([]Route, 0, 3)
+	rr := &Router{
+		Relay:             NewRelay(),
+		ReplicaRetries:    3,
+		ReplicaRetryDelay: time.Second,
+	}
 	rr.getSubRelayFromFilter = func(f nostr.Filter) *Relay {
-		for _, route := range rr.routes {
+		for _, route := range rr.Routes() {
 			if route.filterMatcher(f) {
 				return route.relay
 			}
 		}
 		return rr.Relay
 	}
+	rr.getSubRelaysFromFilter = func(f nostr.Filter) []routedFilter {
+		if !rr.FanOut {
+			return nil
+		}
+		return rr.routeFilter(f)
+	}
 	rr.getSubRelayFromEvent = func(e *nostr.Event) *Relay {
-		for _, route := range rr.routes {
-			if route.eventMatcher(e) {
-				return route.relay
-			}
+		if route := rr.primaryRoute(e); route != nil {
+			return route.relay
 		}
 		return rr.Relay
 	}
+	rr.replicate = rr.replicateEvent
 	return rr
 }
 
+// primaryRoute is the first route that matches the event and is not a mirror
+func (rr *Router) primaryRoute(e *nostr.Event) *Route {
+	routes := rr.Routes()
+	for i, route := range routes {
+		if !route.mirror && route.eventMatcher(e) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// replicateEvent writes an event that was accepted by its primary relay to the replicas of its route and to
+// the mirrors that match it, and makes deletion requests reach every other relay too
+func (rr *Router) replicateEvent(ctx context.Context, evt *nostr.Event, primary *Relay) {
+	// these must keep going after the client is gone
+	ctx = context.WithoutCancel(ctx)
+
+	replicas := make([]*Relay, 0, 2)
+	add := func(relay *Relay) {
+		if relay != primary && !slices.Contains(replicas, relay) {
+			replicas = append(replicas, relay)
+		}
+	}
+	if route := rr.primaryRoute(evt); route != nil {
+		for _, relay := range route.replicas {
+			add(relay)
+		}
+	}
+	for _, route := range rr.Routes() {
+		if route.mirror && route.eventMatcher(evt) {
+			add(route.relay)
+		}
+	}
+
+	// deletions are performed on the replicas and then they are stored there as in the primary
+	handle := func(ctx context.Context, relay *Relay) error { return nil }
+	switch evt.Kind {
+	case 5:
+		handle = func(ctx context.Context, relay *Relay) error { return relay.handleDeleteRequest(ctx, evt) }
+	case 62:
+		handle = func(ctx context.Context, relay *Relay) error { return relay.handleVanishRequest(ctx, evt) }
+	}
+
+	for _, replica := range replicas {
+		go rr.writeWithRetries(evt, func() error {
+			if err := handle(ctx, replica); err != nil {
+				return err
+			}
+			_, err := replica.AddEvent(ctx, evt)
+			return err
+		})
+	}
+
+	// while all the other relays may have some of the deleted events
+	if evt.Kind == 5 || evt.Kind == 62 {
+		for _, relay := range rr.subRelays() {
+			if relay != primary && !slices.Contains(replicas, relay) {
+				go rr.writeWithRetries(evt, func() error { return handle(ctx, relay) })
+			}
+		}
+	}
+}
+
+func (rr *Router) writeWithRetries(evt *nostr.Event, write func() error) {
+	delay := rr.ReplicaRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil {
+			return
+		}
+
+		// rejections are final
+		if !strings.HasPrefix(err.Error(), "error:") || attempt >= rr.ReplicaRetries {
+			rr.Log.Printf("failed to replicate %s: %v\n", evt.ID, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// subRelays returns all the relays this router writes to, including itself
+func (rr *Router) subRelays() []*Relay {
+	relays := []*Relay{rr.Relay}
+	for _, route := range rr.Routes() {
+		for _, relay := range append([]*Relay{route.relay}, route.replicas...) {
+			if !slices.Contains(relays, relay) {
+				relays = append(relays, relay)
+			}
+		}
+	}
+	return relays
+}
+
+// routeFilter returns every relay that should get the filter (or part of it)
+func (rr *Router) routeFilter(f nostr.Filter) []routedFilter {
+	routes := rr.Routes()
+	routed := make([]routedFilter, 0, len(routes))
+	add := func(relay *Relay, filter nostr.Filter) {
+		for i, rf := range routed {
+			if rf.subrelay == relay {
+				// same relay matched by more than one kind
+				routed[i].filter.Kinds = append(rf.filter.Kinds, filter.Kinds...)
+				return
+			}
+		}
+		routed = append(routed, routedFilter{relay, filter})
+	}
+
+	if len(f.Kinds) > 1 {
+		for _, kind := range f.Kinds {
+			single := f
+			single.Kinds = []int{kind}
+			matched := false
+			for _, route := range routes {
+				if route.filterMatcher(single) {
+					add(route.relay, single)
+					matched = true
+				}
+			}
+			if !matched {
+				// kinds no route wants are served by the router itself, as whole filters would be
+				add(rr.Relay, single)
+			}
+		}
+	} else {
+		for _, route := range routes {
+			if route.filterMatcher(f) {
+				add(route.relay, f)
+			}
+		}
+	}
+
+	if len(routed) == 0 {
+		return []routedFilter{{rr.Relay, f}}
+	}
+	return routed
+}
+
+// handleFanOutRequest queries all the relays a filter was routed to and sends their results
+// merged in a single stream, sorted, without duplicates and limited by the filter's limit
+func (rl *Relay) handleFanOutRequest(
+	ctx context.Context,
+	id string,
+	eose *sync.WaitGroup,
+	timedOut *atomic.Bool,
+	ws *WebSocket,
+	filter nostr.Filter,
+	routed []routedFilter,
+) error {
+	defer eose.Done()
+
+	sources := make([]querySource, 0, len(routed))
+	cancels := make([]context.CancelFunc, 0, len(routed))
+	cancelAll := func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+	for _, rf := range routed {
+		_, srcs, cancel, err := rf.subrelay.openQuery(ctx, rf.filter)
+		if err != nil {
+			cancelAll()
+			drainSources(sources)
+			return err
+		}
+		sources = append(sources, srcs...)
+		cancels = append(cancels, cancel)
+	}
+
+	if len(sources) == 0 {
+		cancelAll()
+		return nil
+	}
+
+	eose.Add(1)
+	go func() {
+		rl.streamMergedQueries(ctx, id, ws, filter.Limit, sources)
+		for _, source := range sources {
+			if source.ctx.Err() == context.DeadlineExceeded {
+				timedOut.Store(true)
+			}
+		}
+		cancelAll()
+		eose.Done()
+	}()
+
+	return nil
+}
+
+// Routes returns the current routes, from the highest priority to the lowest.
+func (rr *Router) Routes() []Route {
+	if routes := rr.routes.Load(); routes != nil {
+		return *routes
+	}
+	return nil
+}
+
+// AddRoute adds a route created with Route().Build(), it fails if there is already a route with the same name.
+func (rr *Router) AddRoute(route Route) error {
+	return rr.changeRoutes(func(routes []Route) ([]Route, error) {
+		if route.name != "" && slices.ContainsFunc(routes, func(r Route) bool { return r.name == route.name }) {
+			return nil, fmt.Errorf("there is already a route named '%s'", route.name)
+		}
+		return append(routes, route), nil
+	})
+}
+
+// RemoveRoute removes the route with the given name. Subscriptions that were being served by its relay are
+// moved to wherever their filters are routed now, or closed if that is nowhere.
+func (rr *Router) RemoveRoute(name string) error {
+	return rr.changeRoutes(func(routes []Route) ([]Route, error) {
+		idx := slices.IndexFunc(routes, func(r Route) bool { return r.name == name })
+		if idx == -1 {
+			return nil, fmt.Errorf("there is no route named '%s'", name)
+		}
+		return slices.Delete(routes, idx, idx+1), nil
+	})
+}
+
+// ReplaceRoute swaps the route with the given name for another (which gets the same name, and the same
+// priority unless one was set). Subscriptions are treated like in RemoveRoute.
+func (rr *Router) ReplaceRoute(name string, route Route) error {
+	route.name = name
+	return rr.changeRoutes(func(routes []Route) ([]Route, error) {
+		idx := slices.IndexFunc(routes, func(r Route) bool { return r.name == name })
+		if idx == -1 {
+			return nil, fmt.Errorf("there is no route named '%s'", name)
+		}
+		if !route.hasPriority {
+			route.priority = routes[idx].priority
+			route.hasPriority = routes[idx].hasPriority
+		}
+		routes[idx] = route
+		return routes, nil
+	})
+}
+
+func (rr *Router) changeRoutes(change func(routes []Route) ([]Route, error)) error {
+	rr.routesMutex.Lock()
+	routes, err := change(slices.Clone(rr.Routes()))
+	if err != nil {
+		rr.routesMutex.Unlock()
+		return err
+	}
+	slices.SortStableFunc(routes, func(a, b Route) int { return cmp.Compare(b.priority, a.priority) })
+
+	// no REQ can be routed while we swap the routes and fix the subscriptions
+	rr.routing.Lock()
+	rr.routes.Store(&routes)
+	rr.routesGeneration.Add(1)
+	closed := rr.rerouteListeners()
+	rr.routing.Unlock()
+	rr.routesMutex.Unlock()
+
+	// writing to slow clients may take a while, so that is only done after everything was unlocked
+	for _, sub := range closed {
+		sub.ws.WriteJSON(nostr.ClosedEnvelope{
+			SubscriptionID: sub.id,
+			Reason:         "error: the route for this subscription was removed",
+		})
+	}
+	return nil
+}
+
+type closedSubscription struct {
+	ws *WebSocket
+	id string
+}
+
+// rerouteListeners moves the listeners that are on relays we don't route to anymore to the relays their
+// filters are routed to now, or ends their subscriptions if they would end up in the router itself (the
+// CLOSED messages for these must be sent by the caller)
+func (rr *Router) rerouteListeners() []closedSubscription {
+	live := rr.subRelays()
+	closed := make([]closedSubscription, 0, 2)
+
+	for _, shard := range rr.shards {
+		shard.clientsMutex.Lock()
+		for ws, specs := range shard.clients {
+			ids := make([]string, 0, 1)
+			for _, spec := range specs {
+				if !slices.Contains(live, spec.subrelay) && !slices.Contains(ids, spec.id) {
+					ids = append(ids, spec.id)
+				}
+			}
+
+			for _, id := range ids {
+				var cancel context.CancelCauseFunc
+				gone := false
+				listeners := make([]routedFilter, 0, 2)
+				for _, spec := range shard.clients[ws] {
+					if spec.id != id {
+						continue
+					}
+					cancel = spec.cancel
+
+					lshard := spec.subrelay.shards[ws.shard]
+					lshard.listenersMutex.RLock()
+					filter := lshard.listeners[spec.index].filter
+					lshard.listenersMutex.RUnlock()
+
+					if slices.Contains(live, spec.subrelay) {
+						listeners = append(listeners, routedFilter{spec.subrelay, filter})
+						continue
+					}
+
+					rerouted := rr.routeListener(filter)
+					if len(rerouted) == 0 {
+						gone = true
+						break
+					}
+					listeners = append(listeners, rerouted...)
+				}
+				if gone {
+					rr.removeListenerIdLocked(shard, ws, id, ErrSubscriptionClosedByRelay)
+					closed = append(closed, closedSubscription{ws, id})
+					continue
+				}
+
+				// the subscription goes on, just in other places
+				createdAt := ws.subscriptions[id]
+				rr.removeListenerIdLocked(shard, ws, id, nil)
+				for _, rf := range listeners {
+					rr.addListenerLocked(shard, ws, id, rf.subrelay, rf.filter, cancel)
+				}
+				ws.subscriptions[id] = createdAt
+			}
+		}
+		shard.clientsMutex.Unlock()
+	}
+
+	return closed
+}
+
+// routeListener is where a filter would be routed to if it came in a REQ now, except for the router itself
+func (rr *Router) routeListener(f nostr.Filter) []routedFilter {
+	routed := []routedFilter{{rr.getSubRelayFromFilter(f), f}}
+	if rr.FanOut {
+		routed = rr.routeFilter(f)
+	}
+	return slices.DeleteFunc(routed, func(rf routedFilter) bool { return rf.subrelay == rr.Relay })
+}
+
 func (rr *Router) Route() routeBuilder {
 	return routeBuilder{
 		router:        rr,
@@ -48,6 +436,20 @@ func (rr *Router) Route() routeBuilder {
 	}
 }
 
+// Name is used to change or remove the route later.
+func (rb routeBuilder) Name(name string) routeBuilder {
+	rb.name = name
+	return rb
+}
+
+// Priority decides the order in which routes are tried, the highest first (routes with the same
+// priority are tried in the order they were added).
+func (rb routeBuilder) Priority(priority int) routeBuilder {
+	rb.priority = priority
+	rb.hasPriority = true
+	return rb
+}
+
 func (rb routeBuilder) Req(fn func(nostr.Filter) bool) routeBuilder {
 	rb.filterMatcher = fn
 	return rb
@@ -58,10 +460,37 @@ func (rb routeBuilder) Event(fn func(*nostr.Event) bool) routeBuilder {
 	return rb
 }
 
-func (rb routeBuilder) Relay(relay *Relay) {
-	rb.router.routes = append(rb.router.routes, Route{
+// Replicas are relays that also get the events written to this route, after the main relay accepted them.
+func (rb routeBuilder) Replicas(relays ...*Relay) routeBuilder {
+	rb.replicas = relays
+	return rb
+}
+
+// Mirror makes the route get a copy of the events it matches, which are still written to the first
+// route (that is not a mirror) that matches them, like a replica of all the other routes.
+func (rb routeBuilder) Mirror() routeBuilder {
+	rb.mirror = true
+	return rb
+}
+
+// Build creates a route without adding it, for AddRoute and ReplaceRoute.
+func (rb routeBuilder) Build(relay *Relay) Route {
+	return Route{
+		name:          rb.name,
+		priority:      rb.priority,
+		hasPriority:   rb.hasPriority,
 		filterMatcher: rb.filterMatcher,
 		eventMatcher:  rb.eventMatcher,
 		relay:         relay,
-	})
+		replicas:      rb.replicas,
+		mirror:        rb.mirror,
+	}
+}
+
+// Relay adds the route, replacing the one with the same name if there is one.
+func (rb routeBuilder) Relay(relay *Relay) {
+	route := rb.Build(relay)
+	if route.name == "" || rb.router.ReplaceRoute(route.name, route) != nil {
+		rb.router.AddRoute(route)
+	}
 }
@@ -0,0 +1,344 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterFanOut(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	base := nostr.Now() - 100
+
+	subrelay := func() (*Relay, *lockedStore) {
+		relay := NewRelay()
+		store := &lockedStore{}
+		store.Init()
+		relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+		relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+		return relay, store
+	}
+	articles, articlesStore := subrelay()
+	notes, notesStore := subrelay()
+	spam, spamStore := subrelay()
+
+	router := NewRouter()
+	router.FanOut = true
+	router.Route().
+		Req(func(filter nostr.Filter) bool { return slices.Contains(filter.Kinds, 30023) }).
+		Event(func(event *nostr.Event) bool { return event.Kind == 30023 }).
+		Relay(articles)
+	router.Route().
+		Req(func(filter nostr.Filter) bool {
+			return slices.Contains(filter.Kinds, 1) && slices.Contains(filter.Tags["t"], "spam")
+		}).
+		Event(func(event *nostr.Event) bool { return event.Kind == 1 && event.Tags.FindWithValue("t", "spam") != nil }).
+		Relay(spam)
+	router.Route().
+		Req(func(filter nostr.Filter) bool { return slices.Contains(filter.Kinds, 1) }).
+		Event(func(event *nostr.Event) bool { return event.Kind == 1 }).
+		Relay(notes)
+
+	create := func(kind int, createdAt nostr.Timestamp, tags nostr.Tags) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: createdAt, Kind: kind, Tags: tags, Content: fmt.Sprint(kind, createdAt)}
+		evt.Sign(sk)
+		return evt
+	}
+	articlesStore.SaveEvent(ctx, create(30023, base+1, nostr.Tags{{"d", "a"}}))
+	articlesStore.SaveEvent(ctx, create(30023, base+4, nostr.Tags{{"d", "b"}, {"t", "spam"}}))
+	notesStore.SaveEvent(ctx, create(1, base+2, nil))
+	notesStore.SaveEvent(ctx, create(1, base+5, nil))
+	both := create(1, base+3, nostr.Tags{{"t", "spam"}})
+	notesStore.SaveEvent(ctx, both)
+	spamStore.SaveEvent(ctx, both)
+	spamStore.SaveEvent(ctx, create(1, base+6, nostr.Tags{{"t", "spam"}}))
+
+	// filters with many kinds are split among the routes
+	routed := router.routeFilter(nostr.Filter{Kinds: []int{1, 30023, 7}})
+	require.Len(t, routed, 3)
+	require.Equal(t, []int{30023}, routed[1].filter.Kinds)
+	require.Equal(t, router.Relay, routed[2].subrelay)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	read := func() nostr.Envelope {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return nostr.ParseMessage(string(msg))
+	}
+	query := func(req string) []nostr.Timestamp {
+		conn.WriteMessage(websocket.TextMessage, []byte(req))
+		results := make([]nostr.Timestamp, 0, 6)
+		for {
+			switch env := read().(type) {
+			case *nostr.EventEnvelope:
+				results = append(results, env.Event.CreatedAt-base)
+			case *nostr.EOSEEnvelope:
+				return results
+			}
+		}
+	}
+
+	// results from all the relays come sorted, limited and without duplicates, with a single EOSE
+	require.Equal(t, []nostr.Timestamp{5, 4, 3, 2}, query(`["REQ","a",{"kinds":[1,30023],"limit":4}]`))
+	require.Equal(t, []nostr.Timestamp{6, 4, 3}, query(`["REQ","b",{"kinds":[1,30023],"#t":["spam"]}]`))
+
+	// live events from any of the relays
+	for _, evt := range []*nostr.Event{create(30023, nostr.Now(), nostr.Tags{{"d", "c"}}), create(1, nostr.Now(), nil)} {
+		msg, _ := json.Marshal(nostr.EventEnvelope{Event: *evt})
+		conn.WriteMessage(websocket.TextMessage, msg)
+
+		var received bool
+		for i := 0; i < 2; i++ {
+			switch env := read().(type) {
+			case *nostr.EventEnvelope:
+				require.Equal(t, "a", *env.SubscriptionID)
+				require.Equal(t, evt.ID, env.Event.ID)
+				received = true
+			case *nostr.OKEnvelope:
+				require.True(t, env.OK)
+			}
+		}
+		require.True(t, received)
+	}
+}
+
+func TestRouterReplication(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	subrelay := func() (*Relay, *lockedStore) {
+		relay := NewRelay()
+		store := &lockedStore{}
+		store.Init()
+		relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+		relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+		relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent)
+		return relay, store
+	}
+	has := func(store *lockedStore, id string) bool {
+		ch, _ := store.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+		evt := <-ch
+		return evt != nil
+	}
+
+	notes, notesStore := subrelay()
+	notes.RejectEvent = append(notes.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		return event.Content == "rejected", "blocked: not here"
+	})
+	articles, articlesStore := subrelay()
+	archive, archiveStore := subrelay()
+
+	// this one fails a couple of times before working
+	flaky, flakyStore := subrelay()
+	failures := atomic.Int32{}
+	flaky.StoreEvent = append([]func(ctx context.Context, event *nostr.Event) error{
+		func(ctx context.Context, event *nostr.Event) error {
+			if failures.Add(1) <= 2 {
+				return fmt.Errorf("temporarily unavailable")
+			}
+			return nil
+		},
+	}, flaky.StoreEvent...)
+
+	// and this one never accepts anything
+	picky, _ := subrelay()
+	picky.RejectEvent = append(picky.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		return true, "no"
+	})
+
+	router := NewRouter()
+	router.ReplicaRetryDelay = 10 * time.Millisecond
+	router.Route().
+		Event(func(event *nostr.Event) bool { return event.Kind == 1 }).
+		Replicas(flaky, picky).
+		Relay(notes)
+	router.Route().
+		Event(func(event *nostr.Event) bool { return event.Kind == 30023 }).
+		Relay(articles)
+	router.Route().
+		Event(func(event *nostr.Event) bool { return event.Kind != 5 }).
+		Mirror().
+		Relay(archive)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	publish := func(kind int, content string, tags nostr.Tags) (*nostr.Event, *nostr.OKEnvelope) {
+		evt := &nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Content: content, Tags: tags}
+		evt.Sign(sk)
+		msg, _ := json.Marshal(nostr.EventEnvelope{Event: *evt})
+		conn.WriteMessage(websocket.TextMessage, msg)
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return evt, nostr.ParseMessage(string(msg)).(*nostr.OKEnvelope)
+	}
+	eventually := func(condition func() bool) {
+		require.Eventually(t, condition, 2*time.Second, 10*time.Millisecond)
+	}
+
+	// the OK only depends on the primary, replicas are written to in the background
+	note, ok := publish(1, "hello", nil)
+	require.True(t, ok.OK)
+	require.True(t, has(notesStore, note.ID))
+	eventually(func() bool { return has(flakyStore, note.ID) && has(archiveStore, note.ID) })
+	require.Equal(t, int32(3), failures.Load())
+
+	article, ok := publish(30023, "article", nostr.Tags{{"d", "a"}})
+	require.True(t, ok.OK)
+	eventually(func() bool { return has(archiveStore, article.ID) })
+	require.False(t, has(flakyStore, article.ID))
+
+	// nothing is replicated when the primary rejects
+	rejected, ok := publish(1, "rejected", nil)
+	require.False(t, ok.OK)
+	require.Equal(t, "blocked: not here", ok.Reason)
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, has(archiveStore, rejected.ID))
+
+	// deletions reach every relay
+	_, ok = publish(5, "", nostr.Tags{{"e", note.ID}, {"e", article.ID}})
+	require.True(t, ok.OK)
+	eventually(func() bool {
+		return !has(notesStore, note.ID) && !has(flakyStore, note.ID) && !has(archiveStore, note.ID) &&
+			!has(articlesStore, article.ID) && !has(archiveStore, article.ID)
+	})
+}
+
+func TestRouterRouteChanges(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+
+	subrelay := func() *Relay {
+		relay := NewRelay()
+		store := &lockedStore{}
+		store.Init()
+		relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+		relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+		return relay
+	}
+	notes := subrelay()
+	newNotes := subrelay()
+	urgent := subrelay()
+	general := subrelay()
+
+	isNote := func(filter nostr.Filter) bool { return slices.Contains(filter.Kinds, 1) }
+	router := NewRouter()
+	router.Route().
+		Name("notes").
+		Priority(5).
+		Req(isNote).
+		Event(func(event *nostr.Event) bool { return event.Kind == 1 }).
+		Relay(notes)
+	router.Route().
+		Name("all").
+		Req(func(filter nostr.Filter) bool { return true }).
+		Event(func(event *nostr.Event) bool { return true }).
+		Relay(general)
+
+	// higher priorities come first regardless of when they were added
+	require.NoError(t, router.AddRoute(router.Route().Name("urgent").Priority(10).Req(isNote).Build(urgent)))
+	require.Equal(t, "urgent", router.Routes()[0].Name())
+	require.Equal(t, urgent, router.getSubRelayFromFilter(nostr.Filter{Kinds: []int{1}}))
+	require.NoError(t, router.RemoveRoute("urgent"))
+	require.Equal(t, notes, router.getSubRelayFromFilter(nostr.Filter{Kinds: []int{1}}))
+
+	require.Error(t, router.AddRoute(router.Route().Name("all").Build(urgent)))
+	require.Error(t, router.RemoveRoute("urgent"))
+	require.Error(t, router.ReplaceRoute("urgent", router.Route().Build(urgent)))
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:], nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	read := func() nostr.Envelope {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return nostr.ParseMessage(string(msg))
+	}
+	subscribe := func(id string, kind int) {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`["REQ","%s",{"kinds":[%d]}]`, id, kind)))
+		_, isEOSE := read().(*nostr.EOSEEnvelope)
+		require.True(t, isEOSE)
+	}
+	subscribe("notes", 1)
+	subscribe("articles", 30023)
+
+	// the notes subscription follows the route to its new relay
+	require.NoError(t, router.ReplaceRoute("notes", router.Route().
+		Req(isNote).
+		Event(func(event *nostr.Event) bool { return event.Kind == 1 }).
+		Build(newNotes)))
+	require.Equal(t, "notes", router.Routes()[0].Name())
+	require.Equal(t, 5, router.Routes()[0].priority) // kept from the route that was replaced
+
+	evt := &nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "hello"}
+	evt.Sign(sk)
+	msg, _ := json.Marshal(nostr.EventEnvelope{Event: *evt})
+	conn.WriteMessage(websocket.TextMessage, msg)
+	env := read().(*nostr.EventEnvelope)
+	require.Equal(t, "notes", *env.SubscriptionID)
+	require.Equal(t, evt.ID, env.Event.ID)
+	require.True(t, read().(*nostr.OKEnvelope).OK)
+
+	// nothing else will serve the articles subscription, so it is closed
+	require.NoError(t, router.RemoveRoute("all"))
+	closed := read().(*nostr.ClosedEnvelope)
+	require.Equal(t, "articles", closed.SubscriptionID)
+	require.Contains(t, closed.Reason, "route")
+	require.Len(t, router.Subscriptions(), 1)
+
+	// routes can change while requests are coming in
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			relay := notes
+			if i%2 == 0 {
+				relay = newNotes
+			}
+			router.ReplaceRoute("notes", router.Route().Req(isNote).Build(relay))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		subscribe(fmt.Sprint("s", i), 1)
+	}
+	<-done
+
+	specs := 0
+	for _, shard := range router.shards {
+		shard.clientsMutex.Lock()
+		for _, clientSpecs := range shard.clients {
+			for _, spec := range clientSpecs {
+				require.Equal(t, router.Routes()[0].relay, spec.subrelay)
+				specs++
+			}
+		}
+		shard.clientsMutex.Unlock()
+	}
+	require.Equal(t, 51, specs)
+}
@@ -2,10 +2,13 @@ package khatru
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
@@ -13,6 +16,18 @@ type WebSocket struct {
 	conn  *websocket.Conn
 	mutex sync.Mutex
 
+	// messages are written to the connection by a single goroutine that consumes this
+	queue *outboundQueue
+	relay *Relay
+
+	// which registry shard this connection belongs to, and when each of its subscriptions was created
+	// (guarded by that shard's clientsMutex)
+	shard         int
+	subscriptions map[string]time.Time
+
+	// slots for messages being handled, nil when there is no limit
+	inflight chan struct{}
+
 	// original request
 	Request *http.Request
 
@@ -31,16 +46,54 @@ type WebSocket struct {
 	authLock sync.Mutex
 }
 
+// WriteJSON queues a message to be sent to the client, waiting if the queue is full (except when the
+// relay has MessageWorkers, then it never waits but disconnects clients that let too much pile up).
 func (ws *WebSocket) WriteJSON(any any) error {
-	ws.mutex.Lock()
-	err := ws.conn.WriteJSON(any)
-	ws.mutex.Unlock()
-	return err
+	if ws.queue == nil {
+		ws.mutex.Lock()
+		err := ws.conn.WriteJSON(any)
+		ws.mutex.Unlock()
+		return err
+	}
+
+	data, err := json.Marshal(any)
+	if err != nil {
+		return err
+	}
+
+	msg := outboundMessage{typ: websocket.TextMessage, data: data}
+	switch env := any.(type) {
+	case nostr.EventEnvelope:
+		if env.SubscriptionID != nil {
+			msg.subscriptionID = *env.SubscriptionID
+		}
+	case nostr.EOSEEnvelope:
+		msg.subscriptionID = string(env)
+	}
+	if ws.relay != nil && ws.relay.MessageWorkers > 0 && !ws.relay.OrderedMessages {
+		// we may be running on one of the shared workers, which must never be stuck on a single client
+		return ws.enqueueNow(msg)
+	}
+	return ws.enqueue(msg)
 }
 
+// WriteMessage queues a message to be sent to the client, waiting if the queue is full.
+// Control messages are written immediately.
 func (ws *WebSocket) WriteMessage(t int, b []byte) error {
-	ws.mutex.Lock()
-	err := ws.conn.WriteMessage(t, b)
-	ws.mutex.Unlock()
-	return err
+	if t == websocket.PingMessage || t == websocket.PongMessage || t == websocket.CloseMessage {
+		deadline := time.Now().Add(time.Second)
+		if ws.relay != nil && ws.relay.WriteWait > 0 {
+			deadline = time.Now().Add(ws.relay.WriteWait)
+		}
+		return ws.conn.WriteControl(t, b, deadline)
+	}
+
+	if ws.queue == nil {
+		ws.mutex.Lock()
+		err := ws.conn.WriteMessage(t, b)
+		ws.mutex.Unlock()
+		return err
+	}
+
+	return ws.enqueue(outboundMessage{typ: t, data: b})
 }
@@ -0,0 +1,61 @@
+package khatru
+
+// workerPool is a fixed set of goroutines shared by all connections for handling their messages
+type workerPool struct {
+	tasks chan func()
+}
+
+func newWorkerPool(workers int, queueSize int) *workerPool {
+	pool := &workerPool{
+		tasks: make(chan func(), max(queueSize, 0)),
+	}
+	for range workers {
+		go func() {
+			for task := range pool.tasks {
+				task()
+			}
+		}()
+	}
+	return pool
+}
+
+// dispatchMessage decides where and when a message from a client will be handled, according to
+// OrderedMessages, MaxConcurrentMessagesPerConnection and MessageWorkers.
+// it blocks when the limits are reached, which stops us from reading more from that client.
+func (rl *Relay) dispatchMessage(ws *WebSocket, handle func()) {
+	if rl.OrderedMessages {
+		// one at a time, in the order they arrived
+		handle()
+		return
+	}
+
+	if ws.inflight != nil {
+		select {
+		case ws.inflight <- struct{}{}:
+		case <-ws.Context.Done():
+			return
+		}
+
+		inner := handle
+		handle = func() {
+			defer func() { <-ws.inflight }()
+			inner()
+		}
+	}
+
+	if rl.MessageWorkers <= 0 {
+		go handle()
+		return
+	}
+
+	rl.workersOnce.Do(func() {
+		rl.workers = newWorkerPool(rl.MessageWorkers, rl.MessageQueueSize)
+	})
+	select {
+	case rl.workers.tasks <- handle:
+	case <-ws.Context.Done():
+		if ws.inflight != nil {
+			<-ws.inflight
+		}
+	}
+}